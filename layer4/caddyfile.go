@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"strconv"
 
+	"github.com/RussellLuo/caddy-ext/layer4/l4ratelimit"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -29,6 +30,11 @@ func init() {
 //       <listens...> {
 //           l4proxy [<options...>]
 //       }
+//
+//       <listens...> {
+//           rate_limit <key> <rate> [<options...>]
+//           l4proxy [<options...>]
+//       }
 //   }
 //
 func parseLayer4(d *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
@@ -67,6 +73,14 @@ func parseLayer4(d *caddyfile.Dispenser, _ interface{}) (interface{}, error) {
 					server.Routes = append(server.Routes, &layer4.Route{
 						HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(handler, "handler", "proxy", nil)},
 					})
+				case "rate_limit":
+					handler, err := parseRateLimit(d)
+					if err != nil {
+						return nil, err
+					}
+					server.Routes = append(server.Routes, &layer4.Route{
+						HandlersRaw: []json.RawMessage{caddyconfig.JSONModuleObject(handler, "handler", "rate_limit", nil)},
+					})
 				case "l4tls", "tls":
 					handler, err := parseTLS(d)
 					if err != nil {
@@ -140,6 +154,51 @@ func parseProxyProtocol(d *caddyfile.Dispenser) (*l4proxyprotocol.Handler, error
 	return h, nil
 }
 
+// parseRateLimit sets up a "rate_limit" handler from Caddyfile tokens. Syntax:
+//
+//   rate_limit <key> <rate> [<zone_size>] {
+//       zone_ttl <duration>
+//   }
+//
+func parseRateLimit(d *caddyfile.Dispenser) (*l4ratelimit.Handler, error) {
+	h := new(l4ratelimit.Handler)
+
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 3:
+		size, err := strconv.Atoi(args[2])
+		if err != nil {
+			return nil, d.Errf("zone_size must be an integer; invalid: %v", err)
+		}
+		h.ZoneSize = size
+		fallthrough
+	case 2:
+		h.Rate = args[1]
+		h.Key = args[0]
+	default:
+		return nil, d.ArgErr()
+	}
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "zone_ttl":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("bad zone_ttl value %s: %v", d.Val(), err)
+			}
+			h.ZoneTTL = caddy.Duration(ttl)
+
+		default:
+			return nil, d.Errf("unrecognized subdirective %s", d.Val())
+		}
+	}
+
+	return h, nil
+}
+
 // parseL4proxy sets up a "proxy" handler from Caddyfile tokens. Syntax:
 //
 //   proxy [<upstreams...>] {
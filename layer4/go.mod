@@ -3,6 +3,10 @@ module github.com/RussellLuo/caddy-ext/layer4
 go 1.14
 
 require (
+	github.com/RussellLuo/caddy-ext/ratelimit v0.0.0-00010101000000-000000000000
 	github.com/caddyserver/caddy/v2 v2.4.6
 	github.com/mholt/caddy-l4 v0.0.0-20220125094439-07bd718906ce
+	go.uber.org/zap v1.19.0
 )
+
+replace github.com/RussellLuo/caddy-ext/ratelimit => ../ratelimit
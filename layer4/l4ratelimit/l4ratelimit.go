@@ -0,0 +1,145 @@
+package l4ratelimit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RussellLuo/caddy-ext/ratelimit"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Handler{})
+}
+
+// Handler implements a layer4 handler for limiting the rate of connections.
+//
+// If a client exceeds the rate limit, the connection will be closed
+// immediately without being passed to the next handlers.
+type Handler struct {
+	// The variable used to differentiate one client from another.
+	//
+	// Currently supported variables:
+	//
+	// - `{remote.host}`
+	// - `{remote.ip}` (the same as `{remote.host}`)
+	// - `{remote.port}`
+	// - `{remote.host_prefix.<bits>[.<bits6>]}`
+	// - `{remote.ip_prefix.<bits>[.<bits6>]}`
+	//
+	// Defaults to `{remote.ip}`.
+	Key string `json:"key,omitempty"`
+
+	// The connection rate limit (per key value) specified in connections
+	// per second (r/s) or connections per minute (r/m).
+	Rate string `json:"rate,omitempty"`
+
+	// The size (i.e. the number of key values) of the LRU zone that
+	// keeps states of these key values. Defaults to 10,000.
+	ZoneSize int `json:"zone_size,omitempty"`
+
+	// The idle duration after which the state of a key value will be
+	// removed from the zone. Defaults to 0 (i.e. never expire).
+	ZoneTTL caddy.Duration `json:"zone_ttl,omitempty"`
+
+	keyVar *ratelimit.Var
+	zone   *ratelimit.Zone
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.rate_limit",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (h *Handler) Provision(ctx caddy.Context) (err error) {
+	h.logger = ctx.Logger(h)
+	return h.provision()
+}
+
+func (h *Handler) provision() (err error) {
+	if h.Key == "" {
+		h.Key = "{remote.ip}"
+	}
+	h.keyVar, err = ratelimit.ParseVar(h.Key)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(h.keyVar.Name, "{http.request.remote.") {
+		return fmt.Errorf("unsupported key variable: %q", h.Key)
+	}
+
+	rateSize, rateLimit, err := ratelimit.ParseRate(h.Rate)
+	if err != nil {
+		return err
+	}
+
+	if h.ZoneSize == 0 {
+		h.ZoneSize = 10000 // At most 10,000 keys by default
+	}
+
+	h.zone, err = ratelimit.NewZoneWithTTL(h.ZoneSize, rateSize, int64(rateLimit), time.Duration(h.ZoneTTL))
+	return err
+}
+
+// Cleanup cleans up the resources made by h during provisioning.
+func (h *Handler) Cleanup() error {
+	if h.zone != nil {
+		h.zone.Stop()
+		h.zone.Purge()
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (h *Handler) Validate() error {
+	if h.keyVar == nil {
+		return fmt.Errorf("no key variable")
+	}
+	if h.zone == nil {
+		return fmt.Errorf("no zone created")
+	}
+	if h.ZoneTTL < 0 {
+		return fmt.Errorf("zone_ttl must not be negative: %v", time.Duration(h.ZoneTTL))
+	}
+	return nil
+}
+
+// Handle handles the connection.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	keyValue, err := h.keyVar.EvaluateAddr(cx.RemoteAddr().String())
+	if err != nil {
+		h.logger.Error("failed to evaluate variable",
+			zap.String("variable", h.keyVar.Raw),
+			zap.Error(err),
+		)
+		return next.Handle(cx)
+	}
+
+	if keyValue != "" && !h.zone.Allow(keyValue) {
+		h.logger.Debug("connection is rejected",
+			zap.String("variable", h.keyVar.Raw),
+			zap.String("value", keyValue),
+		)
+		// Close the connection without passing it to the next handlers.
+		return cx.Close()
+	}
+
+	return next.Handle(cx)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner  = (*Handler)(nil)
+	_ caddy.CleanerUpper = (*Handler)(nil)
+	_ caddy.Validator    = (*Handler)(nil)
+	_ layer4.NextHandler = (*Handler)(nil)
+)
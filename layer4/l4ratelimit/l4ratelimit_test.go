@@ -0,0 +1,63 @@
+package l4ratelimit
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+)
+
+// addrConn is a net.Conn with a custom remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestHandler_Handle(t *testing.T) {
+	h := &Handler{
+		Key:    "{remote.ip_prefix.24}",
+		Rate:   "2r/m",
+		logger: zap.NewNop(),
+	}
+	if err := h.provision(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	defer h.Cleanup()
+
+	var handled []string
+	next := layer4.HandlerFunc(func(cx *layer4.Connection) error {
+		handled = append(handled, cx.RemoteAddr().String())
+		return nil
+	})
+
+	remotes := []string{"192.0.2.1:1000", "192.0.2.2:1000", "192.0.2.3:1000", "198.51.100.1:1000"}
+	for _, remote := range remotes {
+		conn, peer := net.Pipe()
+		addr, _ := net.ResolveTCPAddr("tcp", remote)
+		cx := layer4.WrapConnection(addrConn{Conn: conn, remote: addr}, nil)
+
+		if err := h.Handle(cx, next); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+		_ = peer.Close()
+	}
+
+	// The third connection from 192.0.2.0/24 is rejected.
+	want := []string{"192.0.2.1:1000", "192.0.2.2:1000", "198.51.100.1:1000"}
+	if !reflect.DeepEqual(handled, want) {
+		t.Fatalf("Handled: got (%#v), want (%#v)", handled, want)
+	}
+}
+
+func TestHandler_provision(t *testing.T) {
+	h := &Handler{Key: "{query.id}", Rate: "2r/m"}
+	err := h.provision()
+	want := `unsupported key variable: "{query.id}"`
+	if err == nil || err.Error() != want {
+		t.Fatalf("Err: got (%v), want (%#v)", err, want)
+	}
+}
@@ -0,0 +1,204 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Adaptive makes the per-key rate limit adapt to the health of the upstream,
+// by using the AIMD (additive-increase/multiplicative-decrease) algorithm.
+// Only the default rate is adapted, while the tiers in the rules file (see
+// Rules) always keep their own rates.
+//
+// At the end of every interval, if the average latency or the 5xx error rate
+// of the requests within the interval exceeds the threshold, the effective
+// limit will be decreased multiplicatively. Otherwise, it will be increased
+// additively until reaching the configured rate.
+type Adaptive struct {
+	// The threshold of the average latency of the next handlers.
+	// Defaults to 0 (i.e. the latency is ignored).
+	Latency caddy.Duration `json:"latency,omitempty"`
+
+	// The threshold (between 0 and 1) of the rate of 5xx responses.
+	// Defaults to 0 (i.e. the error rate is ignored).
+	ErrorRate float64 `json:"error_rate,omitempty"`
+
+	// The interval at which the effective limit is adjusted. Defaults to 10s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// The factor (between 0 and 1) by which the effective limit is multiplied
+	// when decreasing. Defaults to 0.5.
+	DecreaseFactor float64 `json:"decrease_factor,omitempty"`
+
+	// The number by which the effective limit is increased when recovering.
+	// Defaults to 1/10 of the configured rate limit (at least 1).
+	IncreaseStep int64 `json:"increase_step,omitempty"`
+
+	// The minimum effective limit, which must not be greater than the
+	// configured rate limit. Defaults to 1.
+	MinLimit int64 `json:"min_limit,omitempty"`
+}
+
+func (a *Adaptive) provision(rateLimit int64) {
+	if a.Interval == 0 {
+		a.Interval = caddy.Duration(10 * time.Second)
+	}
+	if a.DecreaseFactor == 0 {
+		a.DecreaseFactor = 0.5
+	}
+	if a.IncreaseStep == 0 {
+		a.IncreaseStep = rateLimit / 10
+		if a.IncreaseStep < 1 {
+			a.IncreaseStep = 1
+		}
+	}
+	if a.MinLimit == 0 {
+		a.MinLimit = 1
+	}
+}
+
+func (a *Adaptive) validate(rateLimit int64) error {
+	if a.Latency <= 0 && a.ErrorRate <= 0 {
+		return fmt.Errorf("adaptive: either latency or error_rate must be specified")
+	}
+	if a.ErrorRate < 0 || a.ErrorRate > 1 {
+		return fmt.Errorf("adaptive: error_rate must be between 0 and 1: %v", a.ErrorRate)
+	}
+	if a.DecreaseFactor <= 0 || a.DecreaseFactor >= 1 {
+		return fmt.Errorf("adaptive: decrease_factor must be between 0 and 1 (exclusive): %v", a.DecreaseFactor)
+	}
+	if a.Interval < 0 || a.IncreaseStep < 0 || a.MinLimit < 0 {
+		return fmt.Errorf("adaptive: interval, increase_step and min_limit must not be negative")
+	}
+	if a.MinLimit > rateLimit {
+		return fmt.Errorf("adaptive: min_limit %d must not be greater than the rate limit %d", a.MinLimit, rateLimit)
+	}
+	return nil
+}
+
+// adaptiveController adjusts the effective limit of a zone according to
+// the statistics of the requests.
+type adaptiveController struct {
+	cfg      *Adaptive
+	maxLimit int64
+	zone     *ShardedZone
+
+	mu         sync.Mutex
+	start      time.Time
+	count      int64
+	errors     int64
+	latencySum time.Duration
+
+	now func() time.Time
+}
+
+func newAdaptiveController(cfg *Adaptive, zone *ShardedZone, maxLimit int64) *adaptiveController {
+	return &adaptiveController{
+		cfg:      cfg,
+		maxLimit: maxLimit,
+		zone:     zone,
+		start:    time.Now(),
+		now:      time.Now,
+	}
+}
+
+// SetMaxLimit changes the configured limit, which the effective limit will
+// never go above.
+func (c *adaptiveController) SetMaxLimit(limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxLimit = limit
+}
+
+// Record records the latency and the status code of a request, and adjusts
+// the effective limit if the current interval is over.
+func (c *adaptiveController) Record(latency time.Duration, status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now := c.now(); now.Sub(c.start) >= time.Duration(c.cfg.Interval) {
+		c.adjust()
+		c.start, c.count, c.errors, c.latencySum = now, 0, 0, 0
+	}
+
+	c.count++
+	c.latencySum += latency
+	if status >= 500 {
+		c.errors++
+	}
+}
+
+// adjust adjusts the effective limit according to the statistics within
+// the current interval. It must be called with c.mu held.
+func (c *adaptiveController) adjust() {
+	limit := c.zone.Limit()
+
+	if c.unhealthy() {
+		limit = int64(float64(limit) * c.cfg.DecreaseFactor)
+		if limit < c.cfg.MinLimit {
+			limit = c.cfg.MinLimit
+		}
+	} else {
+		limit += c.cfg.IncreaseStep
+		if limit > c.maxLimit {
+			limit = c.maxLimit
+		}
+	}
+
+	c.zone.SetLimit(limit)
+}
+
+func (c *adaptiveController) unhealthy() bool {
+	if c.count == 0 {
+		return false
+	}
+	if c.cfg.Latency > 0 && c.latencySum/time.Duration(c.count) > time.Duration(c.cfg.Latency) {
+		return true
+	}
+	if c.cfg.ErrorRate > 0 && float64(c.errors)/float64(c.count) > c.cfg.ErrorRate {
+		return true
+	}
+	return false
+}
+
+// statusRecorder is a response writer which records the status code.
+type statusRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriterWrapper.Write(b)
+}
+
+// Status returns the status code of the response, given the error returned
+// by the handler.
+func (r *statusRecorder) Status(err error) int {
+	if err != nil {
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+			return handlerErr.StatusCode
+		}
+		return http.StatusInternalServerError
+	}
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestAdaptiveController_adjust(t *testing.T) {
+	zone, _ := NewShardedZone(1, 10, time.Second, 100, 0)
+	cfg := &Adaptive{
+		Latency:   caddy.Duration(100 * time.Millisecond),
+		ErrorRate: 0.5,
+		MinLimit:  10,
+	}
+	cfg.provision(100)
+	c := newAdaptiveController(cfg, zone, 100)
+
+	cases := []struct {
+		count      int64
+		errors     int64
+		latencySum time.Duration
+	}{
+		{2, 0, 400 * time.Millisecond}, // slow
+		{2, 2, 20 * time.Millisecond},  // erroneous
+		{2, 0, 20 * time.Millisecond},  // healthy
+		{0, 0, 0},                      // idle
+		{2, 0, 20 * time.Millisecond},  // healthy
+		{4, 1, 20 * time.Millisecond},  // healthy
+		{2, 2, 20 * time.Millisecond},  // erroneous
+		{2, 2, 20 * time.Millisecond},  // erroneous
+	}
+
+	var gotLimits []int64
+	for _, cc := range cases {
+		c.count, c.errors, c.latencySum = cc.count, cc.errors, cc.latencySum
+		c.adjust()
+		gotLimits = append(gotLimits, zone.Limit())
+	}
+
+	// Decrease multiplicatively, increase additively and never go below
+	// the minimum limit.
+	wantLimits := []int64{50, 25, 35, 45, 55, 65, 32, 16}
+	if !reflect.DeepEqual(gotLimits, wantLimits) {
+		t.Fatalf("Limits: got (%#v), want (%#v)", gotLimits, wantLimits)
+	}
+
+	c.count, c.errors = 2, 2
+	c.adjust()
+	if got := zone.Limit(); got != 10 {
+		t.Fatalf("Limit: got (%#v), want (%#v)", got, 10)
+	}
+
+	// Never go above the configured limit.
+	c.count, c.errors = 0, 0
+	for i := 0; i < 20; i++ {
+		c.adjust()
+	}
+	if got := zone.Limit(); got != 100 {
+		t.Fatalf("Limit: got (%#v), want (%#v)", got, 100)
+	}
+}
+
+func TestAdaptiveController_Record(t *testing.T) {
+	zone, _ := NewShardedZone(1, 10, time.Minute, 100, 0)
+	cfg := &Adaptive{ErrorRate: 0.5}
+	cfg.provision(100)
+	c := newAdaptiveController(cfg, zone, 100)
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.start = now
+
+	c.Record(10*time.Millisecond, http.StatusOK)
+	c.Record(10*time.Millisecond, http.StatusBadGateway)
+	c.Record(10*time.Millisecond, http.StatusServiceUnavailable)
+	if got := zone.Limit(); got != 100 {
+		t.Fatalf("Limit: got (%#v), want (%#v)", got, 100)
+	}
+
+	// The adjustment happens at the first request in the next interval.
+	now = now.Add(time.Duration(cfg.Interval))
+	c.Record(10*time.Millisecond, http.StatusOK)
+	if got := zone.Limit(); got != 50 {
+		t.Fatalf("Limit: got (%#v), want (%#v)", got, 50)
+	}
+
+	if got, want := zone.RateLimitPolicyHeader(), "50; w=60"; got != want {
+		t.Fatalf("Header: got (%#v), want (%#v)", got, want)
+	}
+}
+
+func TestStatusRecorder_Status(t *testing.T) {
+	cases := []struct {
+		name       string
+		write      func(w http.ResponseWriter)
+		inErr      error
+		wantStatus int
+	}{
+		{
+			name:       "write header",
+			write:      func(w http.ResponseWriter) { w.WriteHeader(http.StatusBadGateway) },
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "write body",
+			write:      func(w http.ResponseWriter) { _, _ = w.Write([]byte("ok")) },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "handler error",
+			write:      func(w http.ResponseWriter) {},
+			inErr:      caddyhttp.Error(http.StatusServiceUnavailable, nil),
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "other error",
+			write:      func(w http.ResponseWriter) {},
+			inErr:      fmt.Errorf("oops"),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := &statusRecorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: httptest.NewRecorder()}}
+			c.write(rec)
+			if got := rec.Status(c.inErr); got != c.wantStatus {
+				t.Fatalf("Status: got (%#v), want (%#v)", got, c.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdaptive_validate(t *testing.T) {
+	cases := []struct {
+		name       string
+		inAdaptive *Adaptive
+		wantErrStr string
+	}{
+		{
+			name:       "min limit equal to rate limit",
+			inAdaptive: &Adaptive{ErrorRate: 0.5, MinLimit: 10},
+			wantErrStr: "",
+		},
+		{
+			name:       "min limit greater than rate limit",
+			inAdaptive: &Adaptive{ErrorRate: 0.5, MinLimit: 11},
+			wantErrStr: "adaptive: min_limit 11 must not be greater than the rate limit 10",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.inAdaptive.provision(10)
+			errStr := ""
+			if err := c.inAdaptive.validate(10); err != nil {
+				errStr = err.Error()
+			}
+			if errStr != c.wantErrStr {
+				t.Fatalf("Err: got (%#v), want (%#v)", errStr, c.wantErrStr)
+			}
+		})
+	}
+}
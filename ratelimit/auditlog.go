@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AuditLog writes an event, as a JSON line, for each rejected request to
+// a dedicated sink.
+//
+// Each event contains the following fields:
+//
+// - `variable`: the key variable.
+// - `key`: the key value.
+// - `rule`: the rule that rejected the request, i.e. `default`, `global` or the tier name.
+// - `count`: the number of rejections (including unsampled ones) within the current sampling interval.
+// - `client_ip`: the client IP (prefers the first IP in the `X-Forwarded-For` header).
+// - `request`: the request line, e.g. `GET /foo?id=1 HTTP/1.1`.
+type AuditLog struct {
+	// The log writer module (in the `caddy.logging.writers` namespace),
+	// e.g. `file`. Defaults to `stderr`.
+	WriterRaw json.RawMessage `json:"output,omitempty" caddy:"namespace=caddy.logging.writers inline_key=output"`
+
+	// If specified, only a sample of rejections will be logged, to avoid
+	// log floods during attacks. Defaults to nil (i.e. log all rejections).
+	Sampling *AuditSampling `json:"sampling,omitempty"`
+
+	writer io.WriteCloser
+	logger *zap.Logger
+
+	mu    sync.Mutex
+	start time.Time
+	count int64
+
+	now func() time.Time
+}
+
+// AuditSampling configures the sampling of the audit log. Within each
+// interval, the first `<first>` rejections are logged, and thereafter
+// every `<thereafter>`-th rejection is logged. At least one of `<first>`
+// and `<thereafter>` must be specified, otherwise no rejection would be
+// logged at all.
+type AuditSampling struct {
+	// The sampling interval. Defaults to 1s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// The number of rejections logged at the beginning of each interval.
+	// Defaults to 0 (i.e. only log every `<thereafter>`-th rejection).
+	First int64 `json:"first,omitempty"`
+
+	// Log every this-many rejection after the first ones. Defaults to 0
+	// (i.e. drop all rejections after the first ones).
+	Thereafter int64 `json:"thereafter,omitempty"`
+}
+
+func (a *AuditLog) provision(ctx caddy.Context) error {
+	if a.WriterRaw == nil {
+		a.WriterRaw = json.RawMessage(`{"output":"stderr"}`)
+	}
+	mod, err := ctx.LoadModule(a, "WriterRaw")
+	if err != nil {
+		return fmt.Errorf("loading audit log writer module: %v", err)
+	}
+	wo, ok := mod.(caddy.WriterOpener)
+	if !ok {
+		return fmt.Errorf("module %T is not a WriterOpener", mod)
+	}
+	a.writer, err = wo.OpenWriter()
+	if err != nil {
+		return fmt.Errorf("opening audit log writer %s: %v", wo, err)
+	}
+
+	a.init(a.writer)
+	return nil
+}
+
+func (a *AuditLog) init(w io.Writer) {
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	a.logger = zap.New(zapcore.NewCore(
+		zapcore.NewJSONEncoder(encCfg),
+		zapcore.AddSync(w),
+		zap.InfoLevel,
+	))
+
+	if a.Sampling != nil && a.Sampling.Interval == 0 {
+		a.Sampling.Interval = caddy.Duration(time.Second)
+	}
+	a.now = time.Now
+	a.start = a.now()
+}
+
+func (a *AuditLog) validate() error {
+	if s := a.Sampling; s != nil && (s.Interval < 0 || s.First < 0 || s.Thereafter < 0) {
+		return fmt.Errorf("audit_log: interval, first and thereafter must not be negative")
+	}
+	if s := a.Sampling; s != nil && s.First == 0 && s.Thereafter == 0 {
+		return fmt.Errorf("audit_log: sampling requires either first or thereafter")
+	}
+	return nil
+}
+
+func (a *AuditLog) close() error {
+	if a.writer == nil {
+		return nil
+	}
+	return a.writer.Close()
+}
+
+// Log logs the rejection of r if it is sampled.
+func (a *AuditLog) Log(r *http.Request, variable, keyValue, rule string) {
+	ok, count := a.sample()
+	if !ok {
+		return
+	}
+
+	clientIP := ""
+	if ip, err := getClientIP(r, true); err == nil {
+		clientIP = ip.String()
+	}
+
+	a.logger.Info("request rejected",
+		zap.String("variable", variable),
+		zap.String("key", keyValue),
+		zap.String("rule", rule),
+		zap.Int64("count", count),
+		zap.String("client_ip", clientIP),
+		zap.String("request", r.Method+" "+r.RequestURI+" "+r.Proto),
+	)
+}
+
+// sample counts a rejection, and reports whether it should be logged along
+// with the number of rejections within the current interval.
+func (a *AuditLog) sample() (ok bool, count int64) {
+	interval := time.Second
+	if a.Sampling != nil {
+		interval = time.Duration(a.Sampling.Interval)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now := a.now(); now.Sub(a.start) >= interval {
+		a.start, a.count = now, 0
+	}
+	a.count++
+
+	s := a.Sampling
+	if s == nil || a.count <= s.First {
+		return true, a.count
+	}
+	return s.Thereafter > 0 && (a.count-s.First)%s.Thereafter == 0, a.count
+}
@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_Log(t *testing.T) {
+	var buf bytes.Buffer
+	a := new(AuditLog)
+	a.init(&buf)
+
+	r := httptest.NewRequest(http.MethodGet, "/foo?id=1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	a.Log(r, "{query.id}", "1", "default")
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	delete(got, "ts")
+
+	want := map[string]interface{}{
+		"level":     "info",
+		"msg":       "request rejected",
+		"variable":  "{query.id}",
+		"key":       "1",
+		"rule":      "default",
+		"count":     float64(1),
+		"client_ip": "192.0.2.1",
+		"request":   "GET /foo?id=1 HTTP/1.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Event: got (%#v), want (%#v)", got, want)
+	}
+}
+
+func TestAuditLog_sample(t *testing.T) {
+	cases := []struct {
+		name       string
+		inSampling *AuditSampling
+		wantLogged []int64
+	}{
+		{
+			name:       "no sampling",
+			wantLogged: []int64{1, 2, 3, 4, 5, 6, 7, 8},
+		},
+		{
+			name:       "first only",
+			inSampling: &AuditSampling{First: 3},
+			wantLogged: []int64{1, 2, 3},
+		},
+		{
+			name:       "first and thereafter",
+			inSampling: &AuditSampling{First: 2, Thereafter: 3},
+			wantLogged: []int64{1, 2, 5, 8},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := &AuditLog{Sampling: c.inSampling}
+			a.init(&bytes.Buffer{})
+
+			now := time.Now()
+			a.now = func() time.Time { return now }
+			a.start = now
+
+			var gotLogged []int64
+			for i := 0; i < 8; i++ {
+				if ok, count := a.sample(); ok {
+					gotLogged = append(gotLogged, count)
+				}
+			}
+			if !reflect.DeepEqual(gotLogged, c.wantLogged) {
+				t.Fatalf("Logged: got (%#v), want (%#v)", gotLogged, c.wantLogged)
+			}
+
+			// The count is reset in the next interval.
+			now = now.Add(time.Second)
+			if ok, count := a.sample(); !ok || count != 1 {
+				t.Fatalf("Sample: got (%v, %d), want (true, 1)", ok, count)
+			}
+		})
+	}
+}
+
+func TestAuditLog_validate(t *testing.T) {
+	cases := []struct {
+		name       string
+		inSampling *AuditSampling
+		wantErrStr string
+	}{
+		{
+			name:       "no sampling",
+			wantErrStr: "",
+		},
+		{
+			name:       "thereafter only",
+			inSampling: &AuditSampling{Thereafter: 10},
+			wantErrStr: "",
+		},
+		{
+			name:       "empty sampling",
+			inSampling: &AuditSampling{},
+			wantErrStr: "audit_log: sampling requires either first or thereafter",
+		},
+		{
+			name:       "negative first",
+			inSampling: &AuditSampling{First: -1},
+			wantErrStr: "audit_log: interval, first and thereafter must not be negative",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			a := &AuditLog{Sampling: c.inSampling}
+			errStr := ""
+			if err := a.validate(); err != nil {
+				errStr = err.Error()
+			}
+			if errStr != c.wantErrStr {
+				t.Fatalf("Err: got (%#v), want (%#v)", errStr, c.wantErrStr)
+			}
+		})
+	}
+}
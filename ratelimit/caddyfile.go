@@ -3,6 +3,8 @@ package ratelimit
 import (
 	"strconv"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
@@ -14,13 +16,54 @@ func init() {
 
 // parseCaddyfile sets up a handler for rate-limiting from Caddyfile tokens. Syntax:
 //
-//     rate_limit [<matcher>] <key> <rate> [<zone_size> [<reject_status>]]
+//     rate_limit [<matcher>] <key> <rate> [<zone_size> [<reject_status>]] {
+//         zone_ttl            <duration>
+//         zone_shards         <n>
+//         zone_name           <name>
+//         zone_stats_interval <duration>
+//         jwt_key             <key>
+//
+//         global_rate   <rate>
+//         global_reject all|new_keys
+//
+//         rules_file           <path>
+//         rules_check_interval <duration>
+//
+//         adaptive {
+//             latency         <duration>
+//             error_rate      <ratio>
+//             interval        <duration>
+//             decrease_factor <factor>
+//             increase_step   <n>
+//             min_limit       <n>
+//         }
+//
+//         audit_log {
+//             output <writer_module> ...
+//             sampling {
+//                 interval   <duration>
+//                 first      <n>
+//                 thereafter <n>
+//             }
+//         }
+//     }
 //
 // Parameters:
 // - <key>: The variable used to differentiate one client from another.
 // - <rate>: The request rate limit (per key value) specified in requests per second (r/s) or requests per minute (r/m).
 // - <zone_size>: The size (i.e. the number of key values) of the LRU zone that keeps states of these key values. Defaults to 10,000.
 // - <reject_status>: The HTTP status code of the response when a client exceeds the rate. Defaults to 429 (Too Many Requests).
+// - <zone_ttl>: The idle duration after which the state of a key value will be removed from the zone. Defaults to 0 (never expire).
+// - <zone_shards>: The number of shards that the zone is divided into, to reduce lock contention. Defaults to 1.
+// - <zone_name>: The name of the zone, which is shared by handlers and matchers with the same zone name and zone settings. It can't be used with `adaptive` or `rules_file`. Defaults to "" (a private zone).
+// - <zone_stats_interval>: The interval at which the zone stats are logged, if there are any evictions or expirations. Defaults to 1m.
+// - <jwt_key>: The HMAC secret or PEM-encoded public key used to verify the JWT for `{jwt.<claim>}`. If omitted, the JWT will be decoded without verification (while `exp` and `nbf` are always checked).
+// - <global_rate>: The overall request rate limit across all key values. Defaults to "" (no overall limit).
+// - <global_reject>: Which requests to reject when the global rate is exceeded, `all` or `new_keys`. Defaults to `all`.
+// - <rules_file>: The path to a JSON/YAML file of rules (key, rate, exemptions and tiers), which is watched for changes and hot-reloaded.
+// - <rules_check_interval>: The interval at which the rules file is checked for changes. Defaults to 5s.
+// - adaptive: Make the per-key rate limit adapt to the latency and the 5xx error rate of the next handlers (AIMD). Tiers in the rules file are not adapted.
+// - audit_log: Write an event (as a JSON line) for each rejected request to the log writer `<writer_module>` (defaults to `stderr`), optionally sampled (`sampling` requires either `first` or `thereafter`).
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	rl := new(RateLimit)
 	if err := rl.UnmarshalCaddyfile(h.Dispenser); err != nil {
@@ -52,6 +95,334 @@ func (rl *RateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) (err error) {
 		default:
 			return d.ArgErr()
 		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "zone_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad zone_ttl value %s: %v", d.Val(), err)
+				}
+				rl.ZoneTTL = caddy.Duration(ttl)
+
+			case "zone_shards":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("zone_shards must be an integer; invalid: %v", err)
+				}
+				rl.ZoneShards = n
+
+			case "zone_name":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rl.ZoneName = d.Val()
+
+			case "zone_stats_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad zone_stats_interval value %s: %v", d.Val(), err)
+				}
+				rl.ZoneStatsInterval = caddy.Duration(interval)
+
+			case "jwt_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rl.JWTKey = d.Val()
+
+			case "global_rate":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rl.GlobalRate = d.Val()
+
+			case "global_reject":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rl.GlobalReject = d.Val()
+
+			case "rules_file":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rl.RulesFile = d.Val()
+
+			case "rules_check_interval":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				interval, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad rules_check_interval value %s: %v", d.Val(), err)
+				}
+				rl.RulesCheckInterval = caddy.Duration(interval)
+
+			case "adaptive":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a, err := unmarshalAdaptive(d)
+				if err != nil {
+					return err
+				}
+				rl.Adaptive = a
+
+			case "audit_log":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a, err := unmarshalAuditLog(d)
+				if err != nil {
+					return err
+				}
+				rl.AuditLog = a
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func unmarshalAdaptive(d *caddyfile.Dispenser) (*Adaptive, error) {
+	a := new(Adaptive)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch name {
+		case "latency":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("bad latency value %s: %v", d.Val(), err)
+			}
+			a.Latency = caddy.Duration(dur)
+
+		case "error_rate":
+			ratio, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return nil, d.Errf("error_rate must be a number; invalid: %v", err)
+			}
+			a.ErrorRate = ratio
+
+		case "interval":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("bad interval value %s: %v", d.Val(), err)
+			}
+			a.Interval = caddy.Duration(dur)
+
+		case "decrease_factor":
+			factor, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil {
+				return nil, d.Errf("decrease_factor must be a number; invalid: %v", err)
+			}
+			a.DecreaseFactor = factor
+
+		case "increase_step":
+			step, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return nil, d.Errf("increase_step must be an integer; invalid: %v", err)
+			}
+			a.IncreaseStep = step
+
+		case "min_limit":
+			limit, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return nil, d.Errf("min_limit must be an integer; invalid: %v", err)
+			}
+			a.MinLimit = limit
+
+		default:
+			return nil, d.Errf("unrecognized adaptive subdirective %s", name)
+		}
+	}
+	return a, nil
+}
+
+func unmarshalAuditLog(d *caddyfile.Dispenser) (*AuditLog, error) {
+	a := new(AuditLog)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "output":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			moduleName := d.Val()
+
+			// The standard writers are in the caddy package, and do not
+			// implement caddyfile.Unmarshaler.
+			var wo caddy.WriterOpener
+			switch moduleName {
+			case "stdout":
+				wo = caddy.StdoutWriter{}
+			case "stderr":
+				wo = caddy.StderrWriter{}
+			case "discard":
+				wo = caddy.DiscardWriter{}
+			default:
+				modID := "caddy.logging.writers." + moduleName
+				unm, err := caddyfile.UnmarshalModule(d, modID)
+				if err != nil {
+					return nil, err
+				}
+				var ok bool
+				wo, ok = unm.(caddy.WriterOpener)
+				if !ok {
+					return nil, d.Errf("module %s (%T) is not a WriterOpener", modID, unm)
+				}
+			}
+			a.WriterRaw = caddyconfig.JSONModuleObject(wo, "output", moduleName, nil)
+
+		case "sampling":
+			if d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			s, err := unmarshalAuditSampling(d)
+			if err != nil {
+				return nil, err
+			}
+			a.Sampling = s
+
+		default:
+			return nil, d.Errf("unrecognized audit_log subdirective %s", d.Val())
+		}
+	}
+	return a, nil
+}
+
+func unmarshalAuditSampling(d *caddyfile.Dispenser) (*AuditSampling, error) {
+	s := new(AuditSampling)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+
+		switch name {
+		case "interval":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("bad interval value %s: %v", d.Val(), err)
+			}
+			s.Interval = caddy.Duration(dur)
+
+		case "first":
+			n, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return nil, d.Errf("first must be an integer; invalid: %v", err)
+			}
+			s.First = n
+
+		case "thereafter":
+			n, err := strconv.ParseInt(d.Val(), 10, 64)
+			if err != nil {
+				return nil, d.Errf("thereafter must be an integer; invalid: %v", err)
+			}
+			s.Thereafter = n
+
+		default:
+			return nil, d.Errf("unrecognized sampling subdirective %s", name)
+		}
+	}
+	return s, nil
+}
+
+// UnmarshalCaddyfile sets up a matcher for rate-limiting from Caddyfile tokens. Syntax:
+//
+//     rate_limit <key> <rate> [<zone_size>] {
+//         zone_ttl    <duration>
+//         zone_shards <n>
+//         zone_name   <name>
+//         jwt_key     <key>
+//         consume
+//     }
+//
+// Parameters:
+// - <key>: The variable used to differentiate one client from another.
+// - <rate>: The request rate limit (per key value) specified in requests per second (r/s) or requests per minute (r/m).
+// - <zone_size>: The size (i.e. the number of key values) of the LRU zone that keeps states of these key values. Defaults to 10,000.
+// - <zone_ttl>: The idle duration after which the state of a key value will be removed from the zone. Defaults to 0 (never expire).
+// - <zone_shards>: The number of shards that the zone is divided into. Defaults to 1.
+// - <zone_name>: The name of the zone, which is shared by handlers and matchers with the same zone name and zone settings. Defaults to "" (a private zone).
+// - <jwt_key>: The HMAC secret or PEM-encoded public key used to verify the JWT for `{jwt.<claim>}`.
+// - consume: Whether to consume the quota of the key value when matching. Required for a private zone.
+func (m *Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) (err error) {
+	for d.Next() {
+		args := d.RemainingArgs()
+		switch len(args) {
+		case 3:
+			size, err := strconv.Atoi(args[2])
+			if err != nil {
+				return d.Errf("zone_size must be an integer; invalid: %v", err)
+			}
+			m.ZoneSize = size
+			fallthrough
+		case 2:
+			m.Rate = args[1]
+			m.Key = args[0]
+		default:
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "zone_ttl":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				ttl, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad zone_ttl value %s: %v", d.Val(), err)
+				}
+				m.ZoneTTL = caddy.Duration(ttl)
+
+			case "zone_shards":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				shards, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("zone_shards must be an integer; invalid: %v", err)
+				}
+				m.ZoneShards = shards
+
+			case "zone_name":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ZoneName = d.Val()
+
+			case "jwt_key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.JWTKey = d.Val()
+
+			case "consume":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Consume = true
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
 	}
 	return nil
 }
@@ -59,4 +430,5 @@ func (rl *RateLimit) UnmarshalCaddyfile(d *caddyfile.Dispenser) (err error) {
 // Interface guards
 var (
 	_ caddyfile.Unmarshaler = (*RateLimit)(nil)
+	_ caddyfile.Unmarshaler = (*Matcher)(nil)
 )
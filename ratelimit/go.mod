@@ -7,4 +7,5 @@ require (
 	github.com/caddyserver/caddy/v2 v2.4.5
 	github.com/hashicorp/golang-lru v0.5.1
 	go.uber.org/zap v1.19.0
+	gopkg.in/yaml.v2 v2.4.0
 )
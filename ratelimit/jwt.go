@@ -0,0 +1,237 @@
+package ratelimit
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // Register SHA-256 for crypto.SHA256
+	_ "crypto/sha512" // Register SHA-384 and SHA-512 for crypto.SHA384 and crypto.SHA512
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parseJWTKey parses s as the key used to verify JWTs. If s is a PEM-encoded
+// public key (RSA or ECDSA), the parsed public key will be returned. Otherwise,
+// s itself will be used as the HMAC secret.
+func parseJWTKey(s string) (interface{}, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty jwt_key")
+	}
+
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return []byte(s), nil
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt_key: %v", err)
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported jwt_key type: %T", pub)
+	}
+}
+
+// getBearerToken returns the bearer token carried in the Authorization header.
+func getBearerToken(r *http.Request) string {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// decodeJWT decodes the claims from token. The expiration time (`exp`) and
+// the not-before time (`nbf`) of the token are always checked, and if key
+// is not nil, the signature will also be verified.
+func decodeJWT(token string, key interface{}, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %v", err)
+	}
+
+	if err := checkJWTTime(claims, now); err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return claims, nil
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt signature: %v", err)
+	}
+	if err := verifyJWTSignature(header.Alg, parts[0]+"."+parts[1], sig, key); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// checkJWTTime checks the expiration time and the not-before time, if any,
+// in claims.
+func checkJWTTime(claims map[string]interface{}, now time.Time) error {
+	if exp, ok := claims["exp"]; ok {
+		sec, err := jwtNumericDate(exp)
+		if err != nil {
+			return fmt.Errorf("invalid jwt exp: %v", err)
+		}
+		if now.Unix() >= sec {
+			return fmt.Errorf("jwt is expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		sec, err := jwtNumericDate(nbf)
+		if err != nil {
+			return fmt.Errorf("invalid jwt nbf: %v", err)
+		}
+		if now.Unix() < sec {
+			return fmt.Errorf("jwt is not valid yet")
+		}
+	}
+	return nil
+}
+
+// jwtNumericDate returns the seconds of the NumericDate v, ignoring the
+// fractional part.
+func jwtNumericDate(v interface{}) (int64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("not a number: %v", v)
+	}
+	if sec, err := n.Int64(); err == nil {
+		return sec, nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return 0, err
+	}
+	return int64(f), nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func verifyJWTSignature(alg, signingInput string, sig []byte, key interface{}) error {
+	// All the supported algorithms are like "HS256", "RS384" or "ES512".
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported jwt alg: %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported jwt alg: %q", alg)
+	}
+
+	switch k := key.(type) {
+	case []byte:
+		if !strings.HasPrefix(alg, "HS") {
+			return fmt.Errorf("unexpected jwt alg: %q", alg)
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("unexpected jwt alg: %q", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, sig); err != nil {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("unexpected jwt alg: %q", alg)
+		}
+		// The signature is the concatenation of R and S, each of which is
+		// padded to the byte size of the curve.
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported jwt key type: %T", key)
+	}
+}
+
+// getClaim returns the value of the given claim in string. Nested claims
+// can be accessed by using a dot-separated path (e.g. "org.id").
+func getClaim(claims map[string]interface{}, name string) string {
+	var value interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = m[part]; !ok {
+			return ""
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+// newJWT creates a JWT with the given header and claims, which are both
+// JSON strings, and signs it by using sign.
+func newJWT(header, claims string, sign func(signingInput string) []byte) string {
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString([]byte(header)) + "." + enc.EncodeToString([]byte(claims))
+	return signingInput + "." + enc.EncodeToString(sign(signingInput))
+}
+
+func hs256(secret string) func(string) []byte {
+	return func(signingInput string) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(signingInput))
+		return mac.Sum(nil)
+	}
+}
+
+func TestDecodeJWT(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	es256 := func(signingInput string) []byte {
+		digest := sha256.Sum256([]byte(signingInput))
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+	ecPubDER, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	ecPubPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecPubDER}))
+
+	cases := []struct {
+		name       string
+		inToken    string
+		inKey      string
+		wantSub    string
+		wantErrStr string
+	}{
+		{
+			name:    "no verification",
+			inToken: newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1"}`, hs256("wrong")),
+			wantSub: "tenant1",
+		},
+		{
+			name:    "hs256",
+			inToken: newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1"}`, hs256("secret")),
+			inKey:   "secret",
+			wantSub: "tenant1",
+		},
+		{
+			name:       "hs256 with bad signature",
+			inToken:    newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1"}`, hs256("wrong")),
+			inKey:      "secret",
+			wantErrStr: "invalid jwt signature",
+		},
+		{
+			name:       "hs256 expired",
+			inToken:    newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1","exp":1500000000}`, hs256("secret")),
+			inKey:      "secret",
+			wantErrStr: "jwt is expired",
+		},
+		{
+			name:    "es256",
+			inToken: newJWT(`{"alg":"ES256"}`, `{"sub":"tenant1","exp":1700000000}`, es256),
+			inKey:   ecPubPEM,
+			wantSub: "tenant1",
+		},
+		{
+			name:       "es256 with short signature",
+			inToken:    newJWT(`{"alg":"ES256"}`, `{"sub":"tenant1"}`, func(s string) []byte { return es256(s)[1:63] }),
+			inKey:      ecPubPEM,
+			wantErrStr: "invalid jwt signature",
+		},
+		{
+			name:       "expired without verification",
+			inToken:    newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1","exp":1500000000}`, hs256("wrong")),
+			wantErrStr: "jwt is expired",
+		},
+		{
+			name:       "not valid yet",
+			inToken:    newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1","nbf":1700000000}`, hs256("secret")),
+			inKey:      "secret",
+			wantErrStr: "jwt is not valid yet",
+		},
+		{
+			name:       "not valid yet without verification",
+			inToken:    newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1","nbf":1700000000}`, hs256("wrong")),
+			wantErrStr: "jwt is not valid yet",
+		},
+		{
+			name:    "valid nbf and exp with fractions",
+			inToken: newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1","nbf":1500000000.5,"exp":1700000000.5}`, hs256("secret")),
+			inKey:   "secret",
+			wantSub: "tenant1",
+		},
+		{
+			name:       "invalid exp",
+			inToken:    newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1","exp":"tomorrow"}`, hs256("wrong")),
+			wantErrStr: "invalid jwt exp: not a number: tomorrow",
+		},
+		{
+			name:       "alg mismatch",
+			inToken:    newJWT(`{"alg":"HS256"}`, `{"sub":"tenant1"}`, hs256(ecPubPEM)),
+			inKey:      ecPubPEM,
+			wantErrStr: `unexpected jwt alg: "HS256"`,
+		},
+		{
+			name:       "alg none",
+			inToken:    newJWT(`{"alg":"none"}`, `{"sub":"tenant1"}`, func(string) []byte { return nil }),
+			inKey:      "secret",
+			wantErrStr: `unsupported jwt alg: "none"`,
+		},
+		{
+			name:       "malformed",
+			inToken:    "xxx",
+			wantErrStr: "malformed jwt",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var key interface{}
+			if c.inKey != "" {
+				var err error
+				if key, err = parseJWTKey(c.inKey); err != nil {
+					t.Fatalf("Err: %v", err)
+				}
+			}
+
+			claims, err := decodeJWT(c.inToken, key, now)
+			if err != nil {
+				if err.Error() != c.wantErrStr {
+					t.Fatalf("ErrStr: got (%#v), want (%#v)", err.Error(), c.wantErrStr)
+				}
+				return
+			}
+			if c.wantErrStr != "" {
+				t.Fatalf("ErrStr: got (nil), want (%#v)", c.wantErrStr)
+			}
+
+			sub := getClaim(claims, "sub")
+			if sub != c.wantSub {
+				t.Fatalf("Sub: got (%#v), want (%#v)", sub, c.wantSub)
+			}
+		})
+	}
+}
+
+func TestGetClaim(t *testing.T) {
+	claims, _ := decodeJWT(newJWT(`{}`, `{"sub":"x","n":42,"admin":true,"org":{"id":7},"roles":["a","b"]}`, hs256("")), nil, time.Now())
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"sub", "x"},
+		{"n", "42"},
+		{"admin", "true"},
+		{"org.id", "7"},
+		{"roles", `["a","b"]`},
+		{"org.unknown", ""},
+		{"sub.unknown", ""},
+		{"unknown", ""},
+	}
+
+	for _, c := range cases {
+		if got := getClaim(claims, c.in); got != c.want {
+			t.Fatalf("Claim(%q): got (%#v), want (%#v)", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Matcher{})
+}
+
+// Matcher implements a request matcher, which matches requests whose key
+// values have exceeded the rate limit.
+//
+// By default, the matcher only tests the quota without consuming it, which
+// is useful along with a `rate_limit` handler sharing the same zone (see
+// `zone_name`). Enable `consume` to make the matcher a standalone limiter.
+type Matcher struct {
+	// The variable used to differentiate one client from another.
+	// See RateLimit.Key for the supported variables.
+	Key string `json:"key,omitempty"`
+
+	// The key used to verify the JWT for `{jwt.<claim>}`.
+	// See RateLimit.JWTKey for details.
+	JWTKey string `json:"jwt_key,omitempty"`
+
+	// The request rate limit (per key value) specified in requests
+	// per second (r/s) or requests per minute (r/m).
+	Rate string `json:"rate,omitempty"`
+
+	// The size (i.e. the number of key values) of the LRU zone that
+	// keeps states of these key values. Defaults to 10,000.
+	ZoneSize int `json:"zone_size,omitempty"`
+
+	// The idle duration after which the state of a key value will be
+	// removed from the zone. See RateLimit.ZoneTTL.
+	ZoneTTL caddy.Duration `json:"zone_ttl,omitempty"`
+
+	// The number of shards that the zone is divided into. Defaults to 1.
+	// See RateLimit.ZoneShards.
+	ZoneShards int `json:"zone_shards,omitempty"`
+
+	// The name of the zone, which is shared with handlers and matchers
+	// using the same zone name and the same zone settings (i.e. the rate,
+	// the size, the number of shards and the TTL). See RateLimit.ZoneName.
+	// Defaults to "" (i.e. a private zone).
+	ZoneName string `json:"zone_name,omitempty"`
+
+	// Whether to consume the quota of the key value when matching.
+	// Defaults to false, which requires a named zone (see ZoneName), since
+	// nothing else will consume the quota of a private zone.
+	Consume bool `json:"consume,omitempty"`
+
+	keyVar *Var
+	zone   *ShardedZone
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (Matcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.rate_limit",
+		New: func() caddy.Module { return new(Matcher) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *Matcher) Provision(ctx caddy.Context) (err error) {
+	m.logger = ctx.Logger(m)
+	return m.provision()
+}
+
+func (m *Matcher) provision() (err error) {
+	m.keyVar, err = parseKeyVar(m.Key, m.JWTKey)
+	if err != nil {
+		return err
+	}
+
+	rateSize, rateLimit, err := ParseRate(m.Rate)
+	if err != nil {
+		return err
+	}
+
+	if m.ZoneSize == 0 {
+		m.ZoneSize = 10000 // At most 10,000 keys by default
+	}
+
+	if m.ZoneShards == 0 {
+		m.ZoneShards = 1
+	}
+
+	m.zone, err = loadOrNewZone(m.ZoneName, m.ZoneShards, m.ZoneSize, rateSize, int64(rateLimit), time.Duration(m.ZoneTTL))
+	return err
+}
+
+// Cleanup cleans up the resources made by m during provisioning.
+func (m *Matcher) Cleanup() error {
+	if m.zone != nil {
+		releaseZone(m.ZoneName, m.zone)
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *Matcher) Validate() error {
+	if m.keyVar == nil {
+		return fmt.Errorf("no key variable")
+	}
+	if m.zone == nil {
+		return fmt.Errorf("no zone created")
+	}
+	if !m.Consume && m.ZoneName == "" {
+		return fmt.Errorf("consume is required for a private zone (i.e. without zone_name)")
+	}
+	if m.ZoneTTL < 0 {
+		return fmt.Errorf("zone_ttl must not be negative: %v", time.Duration(m.ZoneTTL))
+	}
+	return nil
+}
+
+// Match implements caddyhttp.RequestMatcher.
+func (m *Matcher) Match(r *http.Request) bool {
+	keyValue, err := m.keyVar.Evaluate(r)
+	if err != nil {
+		m.logger.Debug("failed to evaluate variable",
+			zap.String("variable", m.keyVar.Raw),
+			zap.Error(err),
+		)
+		return false
+	}
+	if keyValue == "" {
+		return false
+	}
+
+	if m.Consume {
+		return !m.zone.Allow(keyValue)
+	}
+	return !m.zone.Peek(keyValue)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner        = (*Matcher)(nil)
+	_ caddy.CleanerUpper       = (*Matcher)(nil)
+	_ caddy.Validator          = (*Matcher)(nil)
+	_ caddyhttp.RequestMatcher = (*Matcher)(nil)
+)
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestMatcher_Match(t *testing.T) {
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/foo?id=1", nil)
+		repl := caddyhttp.NewTestReplacer(r)
+		ctx := context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)
+		return r.WithContext(ctx)
+	}
+
+	t.Run("consume", func(t *testing.T) {
+		m := &Matcher{Key: "{query.id}", Rate: "2r/m", Consume: true, logger: zap.NewNop()}
+		if err := m.provision(); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+		defer m.Cleanup()
+
+		var got []bool
+		for i := 0; i < 3; i++ {
+			got = append(got, m.Match(newRequest()))
+		}
+		want := []bool{false, false, true}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Matches: got (%#v), want (%#v)", got, want)
+		}
+	})
+
+	t.Run("shared zone", func(t *testing.T) {
+		m := &Matcher{Key: "{query.id}", Rate: "2r/m", ZoneName: "shared", logger: zap.NewNop()}
+		if err := m.provision(); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+		defer m.Cleanup()
+
+		rl := &RateLimit{Key: "{query.id}", Rate: "2r/m", ZoneName: "shared", logger: zap.NewNop()}
+		if err := rl.provision(); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+		defer rl.Cleanup()
+
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return nil
+		})
+
+		var got []bool
+		for i := 0; i < 3; i++ {
+			// The matcher never consumes the quota.
+			got = append(got, m.Match(newRequest()), m.Match(newRequest()))
+			_ = rl.ServeHTTP(httptest.NewRecorder(), newRequest(), next)
+		}
+		want := []bool{false, false, false, false, true, true}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Matches: got (%#v), want (%#v)", got, want)
+		}
+	})
+}
+
+func TestMatcher_Validate(t *testing.T) {
+	cases := []struct {
+		name       string
+		inMatcher  *Matcher
+		wantErrStr string
+	}{
+		{
+			name:       "consume on private zone",
+			inMatcher:  &Matcher{Key: "{query.id}", Rate: "2r/m", Consume: true},
+			wantErrStr: "",
+		},
+		{
+			name:       "no consume on private zone",
+			inMatcher:  &Matcher{Key: "{query.id}", Rate: "2r/m"},
+			wantErrStr: "consume is required for a private zone (i.e. without zone_name)",
+		},
+		{
+			name:       "no consume on named zone",
+			inMatcher:  &Matcher{Key: "{query.id}", Rate: "2r/m", ZoneName: "validate"},
+			wantErrStr: "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := c.inMatcher
+			m.logger = zap.NewNop()
+			if err := m.provision(); err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+			defer m.Cleanup()
+
+			errStr := ""
+			if err := m.Validate(); err != nil {
+				errStr = err.Error()
+			}
+			if errStr != c.wantErrStr {
+				t.Fatalf("Err: got (%#v), want (%#v)", errStr, c.wantErrStr)
+			}
+		})
+	}
+}
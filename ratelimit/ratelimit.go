@@ -1,6 +1,7 @@
 package ratelimit
 
 import (
+	"crypto/x509/pkix"
 	"fmt"
 	"net"
 	"net/http"
@@ -8,8 +9,10 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	sw "github.com/RussellLuo/slidingwindow"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
@@ -18,11 +21,27 @@ import (
 var (
 	regexpFullVar  = regexp.MustCompile(`^\{http\.request\..+\}$`)
 	regexpShortVar = regexp.MustCompile(`^\{(\w+)\.(.+)\}$`)
-	// "host_prefix.<bits>" or "ip_prefix.<bits>"
-	regexpPrefixVar = regexp.MustCompile(`^(host_prefix|ip_prefix)\.([0-9]+)$`)
+	// "host_prefix.<bits>[.<bits6>]" or "ip_prefix.<bits>[.<bits6>]"
+	regexpPrefixVar = regexp.MustCompile(`^(host_prefix|ip_prefix)\.([0-9]+)(?:\.([0-9]+))?$`)
 	regexpRate      = regexp.MustCompile(`^(\d+)r/(s|m)$`)
 )
 
+// invalidJWTKeyPrefix is the prefix of the key values of `{jwt.<claim>}`
+// for requests without a valid JWT, which are keyed by the remote host.
+const invalidJWTKeyPrefix = "jwt_invalid:"
+
+// subjectAttrs maps the supported attribute names in `{tls.client.subject.<attr>}`
+// to the getters of the corresponding values.
+var subjectAttrs = map[string]func(pkix.Name) []string{
+	"cn":            func(n pkix.Name) []string { return []string{n.CommonName} },
+	"o":             func(n pkix.Name) []string { return n.Organization },
+	"ou":            func(n pkix.Name) []string { return n.OrganizationalUnit },
+	"c":             func(n pkix.Name) []string { return n.Country },
+	"l":             func(n pkix.Name) []string { return n.Locality },
+	"st":            func(n pkix.Name) []string { return n.Province },
+	"serial_number": func(n pkix.Name) []string { return []string{n.SerialNumber} },
+}
+
 func init() {
 	caddy.RegisterModule(RateLimit{})
 }
@@ -48,8 +67,24 @@ type RateLimit struct {
 	// - `{remote.ip}` (prefers the first IP in the `X-Forwarded-For` header)
 	// - `{remote.host_prefix.<bits>}` (CIDR block version of `{remote.host}`)
 	// - `{remote.ip_prefix.<bits>}` (CIDR block version of `{remote.ip}`)
+	// - `{remote.host_prefix.<bits>.<bits6>}` (like `{remote.host_prefix.<bits>}`, but uses `<bits6>` for IPv6)
+	// - `{remote.ip_prefix.<bits>.<bits6>}` (like `{remote.ip_prefix.<bits>}`, but uses `<bits6>` for IPv6)
+	// - `{jwt.<claim>}` (the claim of the bearer JWT in the `Authorization` header,
+	//   or `jwt_invalid:<remote.host>` for requests without a valid JWT)
+	// - `{tls.client.<field>}` (e.g. `{tls.client.subject}` and `{tls.client.fingerprint}`)
+	// - `{tls.client.subject.<attr>}` (`<attr>` is one of `cn`, `o`, `ou`, `c`, `l`, `st` and `serial_number`)
+	//
+	// IPv4-mapped IPv6 addresses (e.g. `::ffff:192.0.2.1`) are treated as IPv4 addresses.
 	Key string `json:"key,omitempty"`
 
+	// The key used to verify the JWT for `{jwt.<claim>}`. It can be either
+	// an HMAC secret (for HS256/HS384/HS512) or a PEM-encoded public key
+	// (for RS256/RS384/RS512 and ES256/ES384/ES512). Environment variables
+	// (e.g. `{env.JWT_SECRET}`) are supported. If omitted, the JWT will be
+	// decoded without verification. The `exp` and `nbf` claims are always
+	// checked.
+	JWTKey string `json:"jwt_key,omitempty"`
+
 	// The request rate limit (per key value) specified in requests
 	// per second (r/s) or requests per minute (r/m).
 	Rate string `json:"rate,omitempty"`
@@ -58,12 +93,82 @@ type RateLimit struct {
 	// keeps states of these key values. Defaults to 10,000.
 	ZoneSize int `json:"zone_size,omitempty"`
 
+	// The idle duration after which the state of a key value will be
+	// removed from the zone. Defaults to 0 (i.e. never expire, and the
+	// states are only evicted when the zone is full).
+	ZoneTTL caddy.Duration `json:"zone_ttl,omitempty"`
+
+	// The number of shards that the zone is divided into. Keys are spread
+	// over shards by hashing, and each shard holds `<zone_size> / <zone_shards>`
+	// key values. Increasing it reduces lock contention under high concurrency.
+	// Defaults to 1.
+	ZoneShards int `json:"zone_shards,omitempty"`
+
+	// The name of the zone. Handlers and matchers with the same zone name
+	// share one zone (i.e. the same states of key values), which also
+	// survives config reloads as long as all the zone settings (i.e. the
+	// rate, the size, the number of shards and the TTL) are the same. Zones
+	// with the same name but different settings are separate zones, so
+	// changing any of the settings in a reload starts from a fresh zone.
+	// A named zone is not compatible with Adaptive or RulesFile, which
+	// change the limit of the zone for all of its users.
+	// Defaults to "" (i.e. a private zone).
+	ZoneName string `json:"zone_name,omitempty"`
+
+	// The interval at which the zone stats (the number of key values, and
+	// the number of evictions and expirations since the last time) are
+	// logged at Info level. Nothing is logged for an interval without any
+	// eviction or expiration. Defaults to 1m.
+	ZoneStatsInterval caddy.Duration `json:"zone_stats_interval,omitempty"`
+
 	// The HTTP status code of the response when a client exceeds the rate.
 	// Defaults to 429 (Too Many Requests).
 	RejectStatusCode int `json:"reject_status,omitempty"`
 
-	keyVar *Var
-	zone   *Zone
+	// The overall request rate limit (across all key values), in addition
+	// to the per-key rate limit. It is specified in requests per second (r/s)
+	// or requests per minute (r/m). Defaults to "" (i.e. no overall limit).
+	GlobalRate string `json:"global_rate,omitempty"`
+
+	// Which requests to reject when the global rate is exceeded:
+	//
+	// - `all`: reject all requests.
+	// - `new_keys`: only reject requests whose key values are new to the zone,
+	//   while the existing key values are only limited by the per-key rate.
+	//
+	// Defaults to `all`.
+	GlobalReject string `json:"global_reject,omitempty"`
+
+	// If specified, the per-key rate limit will adapt to the latency and
+	// the error rate of the next handlers (e.g. `reverse_proxy`). The rate
+	// specified by `<rate>` becomes the maximum limit, and the current
+	// effective limit is reflected in the `RateLimit-Policy` header.
+	Adaptive *Adaptive `json:"adaptive,omitempty"`
+
+	// If specified, an event will be written to a dedicated sink for each
+	// rejected request. See AuditLog for details.
+	AuditLog *AuditLog `json:"audit_log,omitempty"`
+
+	// The path to an external JSON (or YAML, if the file extension is `.yaml`
+	// or `.yml`) file of rules (see Rules), which override the key and the
+	// rate, and add exemptions and tiers. The file is watched for changes and
+	// the rules are applied atomically, while the states of key values are
+	// kept. Defaults to "" (i.e. no rules file).
+	RulesFile string `json:"rules_file,omitempty"`
+
+	// The interval at which the rules file is checked for changes.
+	// Defaults to 5s.
+	RulesCheckInterval caddy.Duration `json:"rules_check_interval,omitempty"`
+
+	keyVar   *Var
+	zone     *ShardedZone
+	global   *sw.Limiter
+	adaptive *adaptiveController
+
+	rules        atomic.Value // *ruleSet
+	rulesModTime time.Time
+	stopRules    chan struct{}
+	stopStats    chan struct{}
 
 	logger *zap.Logger
 }
@@ -79,16 +184,33 @@ func (RateLimit) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (rl *RateLimit) Provision(ctx caddy.Context) (err error) {
 	rl.logger = ctx.Logger(rl)
-	return rl.provision()
+	if err := rl.provision(); err != nil {
+		return err
+	}
+
+	if rl.AuditLog != nil {
+		if err := rl.AuditLog.provision(ctx); err != nil {
+			return err
+		}
+	}
+
+	if rl.RulesFile != "" {
+		rl.stopRules = make(chan struct{})
+		go rl.watchRules(time.Duration(rl.RulesCheckInterval), rl.stopRules)
+	}
+
+	rl.stopStats = make(chan struct{})
+	go rl.logZoneStats(time.Duration(rl.ZoneStatsInterval), rl.stopStats)
+	return nil
 }
 
 func (rl *RateLimit) provision() (err error) {
-	rl.keyVar, err = ParseVar(rl.Key)
+	rl.keyVar, err = parseKeyVar(rl.Key, rl.JWTKey)
 	if err != nil {
 		return err
 	}
 
-	rateSize, rateLimit, err := parseRate(rl.Rate)
+	rateSize, rateLimit, err := ParseRate(rl.Rate)
 	if err != nil {
 		return err
 	}
@@ -97,7 +219,15 @@ func (rl *RateLimit) provision() (err error) {
 		rl.ZoneSize = 10000 // At most 10,000 keys by default
 	}
 
-	rl.zone, err = NewZone(rl.ZoneSize, rateSize, int64(rateLimit))
+	if rl.ZoneShards == 0 {
+		rl.ZoneShards = 1
+	}
+
+	if rl.ZoneStatsInterval == 0 {
+		rl.ZoneStatsInterval = caddy.Duration(time.Minute)
+	}
+
+	rl.zone, err = loadOrNewZone(rl.ZoneName, rl.ZoneShards, rl.ZoneSize, rateSize, int64(rateLimit), time.Duration(rl.ZoneTTL))
 	if err != nil {
 		return err
 	}
@@ -106,13 +236,56 @@ func (rl *RateLimit) provision() (err error) {
 		rl.RejectStatusCode = http.StatusTooManyRequests
 	}
 
-	return nil
+	if rl.GlobalRate != "" {
+		globalSize, globalLimit, err := ParseRate(rl.GlobalRate)
+		if err != nil {
+			return fmt.Errorf("invalid global_rate: %v", err)
+		}
+		rl.global = newLocalLimiter(globalSize, int64(globalLimit))
+	}
+
+	if rl.GlobalReject == "" {
+		rl.GlobalReject = "all"
+	}
+
+	if rl.Adaptive != nil {
+		rl.Adaptive.provision(int64(rateLimit))
+		rl.adaptive = newAdaptiveController(rl.Adaptive, rl.zone, int64(rateLimit))
+	}
+
+	if rl.RulesFile == "" {
+		rl.rules.Store(&ruleSet{
+			keyVar: rl.keyVar,
+			limit:  int64(rateLimit),
+			exempt: &valueSet{},
+		})
+		return nil
+	}
+
+	if rl.RulesCheckInterval == 0 {
+		rl.RulesCheckInterval = caddy.Duration(5 * time.Second)
+	}
+	return rl.loadRules()
 }
 
 // Cleanup cleans up the resources made by rl during provisioning.
 func (rl *RateLimit) Cleanup() error {
+	if rl.stopRules != nil {
+		close(rl.stopRules)
+	}
+	if rl.stopStats != nil {
+		close(rl.stopStats)
+	}
+	if rl.AuditLog != nil {
+		if err := rl.AuditLog.close(); err != nil && rl.logger != nil {
+			rl.logger.Error("failed to close audit log", zap.Error(err))
+		}
+	}
+	if rs, ok := rl.rules.Load().(*ruleSet); ok {
+		rs.release(nil)
+	}
 	if rl.zone != nil {
-		rl.zone.Purge()
+		releaseZone(rl.ZoneName, rl.zone)
 	}
 	return nil
 }
@@ -128,40 +301,166 @@ func (rl *RateLimit) Validate() error {
 	if http.StatusText(rl.RejectStatusCode) == "" {
 		return fmt.Errorf("unknown code reject_status: %d", rl.RejectStatusCode)
 	}
+	if rl.GlobalReject != "all" && rl.GlobalReject != "new_keys" {
+		return fmt.Errorf("unknown global_reject: %q", rl.GlobalReject)
+	}
+	if rl.ZoneName != "" && rl.Adaptive != nil {
+		return fmt.Errorf("adaptive is not supported for a named zone (i.e. with zone_name)")
+	}
+	if rl.ZoneName != "" && rl.RulesFile != "" {
+		return fmt.Errorf("rules_file is not supported for a named zone (i.e. with zone_name)")
+	}
+	if rl.Adaptive != nil {
+		if err := rl.Adaptive.validate(rl.rules.Load().(*ruleSet).limit); err != nil {
+			return err
+		}
+	}
+	if rl.ZoneTTL < 0 {
+		return fmt.Errorf("zone_ttl must not be negative: %v", time.Duration(rl.ZoneTTL))
+	}
+	if rl.ZoneStatsInterval < 0 {
+		return fmt.Errorf("zone_stats_interval must not be negative: %v", time.Duration(rl.ZoneStatsInterval))
+	}
+	if rl.RulesCheckInterval < 0 {
+		return fmt.Errorf("rules_check_interval must not be negative: %v", time.Duration(rl.RulesCheckInterval))
+	}
+	if rl.AuditLog != nil {
+		if err := rl.AuditLog.validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// logZoneStats logs the zone stats periodically, if there are any evictions
+// or expirations since the last time, until stopC is closed.
+func (rl *RateLimit) logZoneStats(interval time.Duration, stopC <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := rl.zone.Stats()
+	for {
+		select {
+		case <-ticker.C:
+			stats := rl.zone.Stats()
+			evictions := stats.Evictions - last.Evictions
+			expirations := stats.Expirations - last.Expirations
+			last = stats
+			if evictions == 0 && expirations == 0 {
+				continue
+			}
+			rl.logger.Info("zone stats",
+				zap.String("zone", rl.ZoneName),
+				zap.Int("size", stats.Size),
+				zap.Uint64("evictions", evictions),
+				zap.Uint64("expirations", expirations),
+			)
+		case <-stopC:
+			return
+		}
+	}
+}
+
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (rl *RateLimit) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	keyValue, err := rl.keyVar.Evaluate(r)
+	rules := rl.rules.Load().(*ruleSet)
+
+	keyValue, err := rules.keyVar.Evaluate(r)
 	if err != nil {
-		rl.logger.Error("failed to evaluate variable",
-			zap.String("variable", rl.keyVar.Raw),
+		rl.logger.Debug("failed to evaluate variable",
+			zap.String("variable", rules.keyVar.Raw),
 			zap.Error(err),
 		)
+		if rl.global == nil {
+			return next.ServeHTTP(w, r)
+		}
+		// The global rate limit still applies.
+		keyValue = ""
+	}
+
+	if keyValue != "" && rules.exempt.Contains(keyValue) {
 		return next.ServeHTTP(w, r)
 	}
 
-	w.Header().Add("RateLimit-Policy", rl.zone.RateLimitPolicyHeader())
+	zone, rule := rl.zone, "default"
+	if t := rules.match(keyValue); t != nil {
+		zone, rule = t.zone, t.name
+	}
+	w.Header().Add("RateLimit-Policy", zone.RateLimitPolicyHeader())
+	if rl.global != nil {
+		w.Header().Add("RateLimit-Policy", fmt.Sprintf("%d; w=%d", rl.global.Limit(), int(rl.global.Size().Seconds())))
+	}
 
-	if keyValue != "" && !rl.zone.Allow(keyValue) {
+	if ok, limit := rl.allow(zone, keyValue); !ok {
 		rl.logger.Debug("request is rejected",
-			zap.String("variable", rl.keyVar.Raw),
+			zap.String("variable", rules.keyVar.Raw),
 			zap.String("value", keyValue),
+			zap.String("limit", limit),
 		)
+		if rl.AuditLog != nil {
+			if limit == "global" {
+				rule = "global"
+			}
+			rl.AuditLog.Log(r, rules.keyVar.Raw, keyValue, rule)
+		}
 
 		w.WriteHeader(rl.RejectStatusCode)
 		// Return an error to invoke possible error handlers.
 		return caddyhttp.Error(rl.RejectStatusCode, nil)
 	}
 
+	if rl.adaptive != nil {
+		rec := &statusRecorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+		start := time.Now()
+		err := next.ServeHTTP(rec, r)
+		rl.adaptive.Record(time.Since(start), rec.Status(err))
+		return err
+	}
+
 	return next.ServeHTTP(w, r)
 }
 
+// allow reports whether the request with the given key value, whose states
+// are kept in zone, is allowed.
+// If not, it also returns which limit ("key" or "global") is exceeded.
+func (rl *RateLimit) allow(zone *ShardedZone, keyValue string) (ok bool, limit string) {
+	if rl.global == nil {
+		return keyValue == "" || zone.Allow(keyValue), "key"
+	}
+
+	if keyValue == "" || !zone.Contains(keyValue) {
+		// For new key values, check the global limit first, to avoid
+		// adding key values of rejected requests into the zone.
+		if !rl.global.Allow() {
+			return false, "global"
+		}
+		return keyValue == "" || zone.Allow(keyValue), "key"
+	}
+
+	// For existing key values, check the per-key limit first, to avoid
+	// consuming the global quota by requests exceeding the per-key limit.
+	if !zone.Allow(keyValue) {
+		return false, "key"
+	}
+	if !rl.global.Allow() && rl.GlobalReject == "all" {
+		return false, "global"
+	}
+	return true, ""
+}
+
 type Var struct {
 	Raw  string
 	Name string
 	Bits int
+	// The prefix length for IPv6 addresses. Zero means using Bits
+	// for both IPv4 and IPv6 addresses.
+	Bits6 int
+	// The field within the variable, i.e. the claim name for `{jwt.<claim>}`
+	// and the attribute name for `{tls.client.subject.<attr>}`.
+	Field string
+	// The key used to verify JWTs, which is either an HMAC secret ([]byte),
+	// an *rsa.PublicKey or an *ecdsa.PublicKey. Nil means no verification.
+	JWTKey interface{}
 }
 
 // ParseVar transforms shorthand variables into Caddy-style placeholders.
@@ -178,6 +477,11 @@ type Var struct {
 // - `{remote.ip}`
 // - `{remote.host_prefix.<bits>}`
 // - `{remote.ip_prefix.<bits>}`
+// - `{remote.host_prefix.<bits>.<bits6>}`
+// - `{remote.ip_prefix.<bits>.<bits6>}`
+// - `{jwt.<claim>}`
+// - `{tls.client.<field>}`
+// - `{tls.client.subject.<attr>}`
 func ParseVar(s string) (*Var, error) {
 	v := &Var{Raw: s}
 	if regexpFullVar.MatchString(s) {
@@ -204,6 +508,22 @@ func ParseVar(s string) (*Var, error) {
 		v.Name = fmt.Sprintf("{http.request.cookie.%s}", name)
 	case "body":
 		v.Name = fmt.Sprintf("{http.request.body.%s}", name)
+	case "jwt":
+		v.Name = "{http.request.jwt}"
+		v.Field = name
+	case "tls":
+		if !strings.HasPrefix(name, "client.") {
+			return nil, fmt.Errorf("invalid key variable: %q", s)
+		}
+		if attr := strings.TrimPrefix(name, "client.subject."); attr != name {
+			if _, ok := subjectAttrs[attr]; !ok {
+				return nil, fmt.Errorf("invalid key variable: %q", s)
+			}
+			v.Name = "{http.request.tls.client.subject}"
+			v.Field = attr
+			return v, nil
+		}
+		v.Name = fmt.Sprintf("{http.request.tls.%s}", name)
 	case "remote":
 		if name == "host" || name == "port" || name == "ip" {
 			v.Name = fmt.Sprintf("{http.request.remote.%s}", name)
@@ -211,7 +531,7 @@ func ParseVar(s string) (*Var, error) {
 		}
 
 		r := regexpPrefixVar.FindStringSubmatch(name)
-		if len(r) != 3 {
+		if len(r) != 4 {
 			return nil, fmt.Errorf("invalid key variable: %q", s)
 		}
 
@@ -225,6 +545,17 @@ func ParseVar(s string) (*Var, error) {
 			return nil, err
 		}
 		v.Bits = bits
+
+		if r[3] != "" {
+			bits6, err := strconv.Atoi(r[3])
+			if err != nil {
+				return nil, err
+			}
+			if bits > 32 || bits6 == 0 || bits6 > 128 {
+				return nil, fmt.Errorf("invalid key variable: %q", s)
+			}
+			v.Bits6 = bits6
+		}
 	default:
 		return nil, fmt.Errorf("unrecognized key variable: %q", s)
 	}
@@ -232,6 +563,25 @@ func ParseVar(s string) (*Var, error) {
 	return v, nil
 }
 
+// parseKeyVar parses the key variable, along with the optional JWT key
+// which may contain global placeholders (e.g. `{env.JWT_SECRET}`).
+func parseKeyVar(key, jwtKey string) (v *Var, err error) {
+	v, err = ParseVar(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if jwtKey != "" {
+		repl := caddy.NewReplacer()
+		v.JWTKey, err = parseJWTKey(repl.ReplaceKnown(jwtKey, ""))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
 func (v *Var) Evaluate(r *http.Request) (value string, err error) {
 	switch v.Name {
 	case "{http.request.remote.ip}":
@@ -244,6 +594,13 @@ func (v *Var) Evaluate(r *http.Request) (value string, err error) {
 		return v.evaluatePrefix(r, false)
 	case "{http.request.remote.ip_prefix}":
 		return v.evaluatePrefix(r, true)
+	case "{http.request.jwt}":
+		return v.evaluateJWT(r)
+	case "{http.request.tls.client.subject}":
+		if v.Field != "" {
+			return v.evaluateSubject(r), nil
+		}
+		fallthrough
 	default:
 		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
 		value = repl.ReplaceAll(v.Name, "")
@@ -251,18 +608,82 @@ func (v *Var) Evaluate(r *http.Request) (value string, err error) {
 	}
 }
 
+// EvaluateAddr is like Evaluate, but evaluates the variable against the given
+// remote address (e.g. of a layer4 connection) instead of an HTTP request.
+// Only `{remote.*}` variables are supported, and `{remote.ip}` is the same
+// as `{remote.host}` since there is no `X-Forwarded-For` header.
+func (v *Var) EvaluateAddr(addr string) (value string, err error) {
+	switch v.Name {
+	case "{http.request.remote.host}", "{http.request.remote.ip}":
+		ip, err := parseIP(addr)
+		if err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	case "{http.request.remote.port}":
+		_, port, err := net.SplitHostPort(addr)
+		return port, err
+	case "{http.request.remote.host_prefix}", "{http.request.remote.ip_prefix}":
+		ip, err := parseIP(addr)
+		if err != nil {
+			return "", err
+		}
+		return v.prefix(ip)
+	default:
+		return "", fmt.Errorf("unsupported variable for addresses: %q", v.Raw)
+	}
+}
+
 func (v *Var) evaluatePrefix(r *http.Request, forwarded bool) (value string, err error) {
 	ip, err := getClientIP(r, forwarded)
 	if err != nil {
 		return "", err
 	}
-	prefix, err := ip.Prefix(v.Bits)
+	return v.prefix(ip)
+}
+
+// prefix returns the CIDR block, which contains ip, in string.
+func (v *Var) prefix(ip netip.Addr) (value string, err error) {
+	bits := v.Bits
+	if ip.Is6() && v.Bits6 != 0 {
+		bits = v.Bits6
+	}
+	prefix, err := ip.Prefix(bits)
 	if err != nil {
 		return "", err
 	}
 	return prefix.Masked().String(), nil
 }
 
+// evaluateJWT returns the claim of the bearer JWT. For requests without
+// a valid JWT (or without the claim), which must still be limited, it falls
+// back to the remote host (ignoring the forgeable `X-Forwarded-For` header)
+// with the prefix invalidJWTKeyPrefix.
+func (v *Var) evaluateJWT(r *http.Request) (value string, err error) {
+	if token := getBearerToken(r); token != "" {
+		claims, err := decodeJWT(token, v.JWTKey, time.Now())
+		if err == nil {
+			if value := getClaim(claims, v.Field); value != "" {
+				return value, nil
+			}
+		}
+	}
+
+	ip, err := getClientIP(r, false)
+	if err != nil {
+		return "", err
+	}
+	return invalidJWTKeyPrefix + ip.String(), nil
+}
+
+func (v *Var) evaluateSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	subject := r.TLS.PeerCertificates[0].Subject
+	return strings.Join(subjectAttrs[v.Field](subject), ",")
+}
+
 func getClientIP(r *http.Request, forwarded bool) (netip.Addr, error) {
 	remote := r.RemoteAddr
 	if forwarded {
@@ -270,14 +691,27 @@ func getClientIP(r *http.Request, forwarded bool) (netip.Addr, error) {
 			remote = strings.TrimSpace(strings.Split(fwdFor, ",")[0])
 		}
 	}
+	return parseIP(remote)
+}
+
+// parseIP parses the IP from remote, which is an address with or without a port.
+func parseIP(remote string) (netip.Addr, error) {
 	ipStr, _, err := net.SplitHostPort(remote)
 	if err != nil {
 		ipStr = remote // OK; probably didn't have a port
 	}
-	return netip.ParseAddr(ipStr)
+	ip, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	// Treat IPv4-mapped IPv6 addresses as IPv4 addresses, so that the
+	// same client always gets the same key.
+	return ip.Unmap(), nil
 }
 
-func parseRate(rate string) (size time.Duration, limit int, err error) {
+// ParseRate parses rate in the form of "<limit>r/s" or "<limit>r/m", and
+// returns the window size and the limit within a window.
+func ParseRate(rate string) (size time.Duration, limit int, err error) {
 	if rate == "" {
 		return 0, 0, fmt.Errorf("missing rate")
 	}
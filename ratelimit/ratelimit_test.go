@@ -2,14 +2,19 @@ package ratelimit
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestRateLimit_ServeHTTP(t *testing.T) {
@@ -21,6 +26,7 @@ func TestRateLimit_ServeHTTP(t *testing.T) {
 	cases := []struct {
 		inRL            *RateLimit
 		inReq           *http.Request
+		inReqs          []*http.Request
 		wantStatusCodes []int
 	}{
 		{
@@ -36,6 +42,75 @@ func TestRateLimit_ServeHTTP(t *testing.T) {
 				http.StatusTooManyRequests,
 			},
 		},
+		{
+			inRL: &RateLimit{
+				Key:        "{query.id}",
+				Rate:       "2r/m",
+				GlobalRate: "3r/m",
+				logger:     zap.NewNop(),
+			},
+			inReqs: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "/foo?id=1", nil),
+				httptest.NewRequest(http.MethodGet, "/foo?id=1", nil),
+				httptest.NewRequest(http.MethodGet, "/foo?id=1", nil), // per-key limit exceeded
+				httptest.NewRequest(http.MethodGet, "/foo?id=2", nil),
+				httptest.NewRequest(http.MethodGet, "/foo?id=2", nil), // global limit exceeded
+				httptest.NewRequest(http.MethodGet, "/foo", nil),      // global limit exceeded
+			},
+			wantStatusCodes: []int{
+				http.StatusOK,
+				http.StatusOK,
+				http.StatusTooManyRequests,
+				http.StatusOK,
+				http.StatusTooManyRequests,
+				http.StatusTooManyRequests,
+			},
+		},
+		{
+			inRL: &RateLimit{
+				Key:          "{query.id}",
+				Rate:         "2r/m",
+				GlobalRate:   "2r/m",
+				GlobalReject: "new_keys",
+				logger:       zap.NewNop(),
+			},
+			inReqs: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "/foo?id=1", nil),
+				httptest.NewRequest(http.MethodGet, "/foo?id=2", nil),
+				httptest.NewRequest(http.MethodGet, "/foo?id=3", nil), // new key rejected
+				httptest.NewRequest(http.MethodGet, "/foo?id=1", nil), // existing key allowed
+				httptest.NewRequest(http.MethodGet, "/foo?id=1", nil), // per-key limit exceeded
+				httptest.NewRequest(http.MethodGet, "/foo?id=3", nil), // new key rejected
+			},
+			wantStatusCodes: []int{
+				http.StatusOK,
+				http.StatusOK,
+				http.StatusTooManyRequests,
+				http.StatusOK,
+				http.StatusTooManyRequests,
+				http.StatusTooManyRequests,
+			},
+		},
+		{
+			inRL: &RateLimit{
+				Key:    "{jwt.sub}",
+				Rate:   "2r/m",
+				JWTKey: "secret",
+				logger: zap.NewNop(),
+			},
+			inReqs: []*http.Request{
+				newRequestWithAuth("Bearer x"),
+				newRequestWithAuth("Bearer y"),
+				newRequestWithAuth(""), // requests without a valid JWT share one limit
+				newRequestWithAuth("Bearer "+newJWT(`{"alg":"HS256"}`, `{"sub":"u1"}`, hs256("secret"))),
+			},
+			wantStatusCodes: []int{
+				http.StatusOK,
+				http.StatusOK,
+				http.StatusTooManyRequests,
+				http.StatusOK,
+			},
+		},
 	}
 	for _, c := range cases {
 		_ = c.inRL.provision()
@@ -43,10 +118,15 @@ func TestRateLimit_ServeHTTP(t *testing.T) {
 
 		var gotStatusCodes []int
 		for i := 0; i < len(c.wantStatusCodes); i++ {
+			inReq := c.inReq
+			if c.inReqs != nil {
+				inReq = c.inReqs[i]
+			}
+
 			// Build the request object.
-			repl := caddyhttp.NewTestReplacer(c.inReq)
-			ctx := context.WithValue(c.inReq.Context(), caddy.ReplacerCtxKey, repl)
-			req := c.inReq.WithContext(ctx)
+			repl := caddyhttp.NewTestReplacer(inReq)
+			ctx := context.WithValue(inReq.Context(), caddy.ReplacerCtxKey, repl)
+			req := inReq.WithContext(ctx)
 
 			// Build the response object.
 			w := httptest.NewRecorder()
@@ -134,6 +214,63 @@ func TestParseVar(t *testing.T) {
 				Bits: 64,
 			},
 		},
+		{
+			in: "{remote.ip_prefix.32.64}",
+			want: &Var{
+				Raw:   "{remote.ip_prefix.32.64}",
+				Name:  "{http.request.remote.ip_prefix}",
+				Bits:  32,
+				Bits6: 64,
+			},
+		},
+		{
+			in: "{remote.host_prefix.24.56}",
+			want: &Var{
+				Raw:   "{remote.host_prefix.24.56}",
+				Name:  "{http.request.remote.host_prefix}",
+				Bits:  24,
+				Bits6: 56,
+			},
+		},
+		{
+			in:         "{remote.ip_prefix.64.64}",
+			wantErrStr: `invalid key variable: "{remote.ip_prefix.64.64}"`,
+		},
+		{
+			in:         "{remote.ip_prefix.32.0}",
+			wantErrStr: `invalid key variable: "{remote.ip_prefix.32.0}"`,
+		},
+		{
+			in: "{jwt.sub}",
+			want: &Var{
+				Raw:   "{jwt.sub}",
+				Name:  "{http.request.jwt}",
+				Field: "sub",
+			},
+		},
+		{
+			in: "{tls.client.fingerprint}",
+			want: &Var{
+				Raw:  "{tls.client.fingerprint}",
+				Name: "{http.request.tls.client.fingerprint}",
+			},
+		},
+		{
+			in: "{tls.client.subject.cn}",
+			want: &Var{
+				Raw:   "{tls.client.subject.cn}",
+				Name:  "{http.request.tls.client.subject}",
+				Field: "cn",
+			},
+		},
+		{
+			in:         "{tls.client.subject.xx}",
+			wantErrStr: `invalid key variable: "{tls.client.subject.xx}"`,
+		},
+		{
+			in:         "{tls.version}",
+			wantErrStr: `invalid key variable: "{tls.version}"`,
+		},
 		{
 			in:         "{remote.host_prefix}",
 			wantErrStr: `invalid key variable: "{remote.host_prefix}"`,
@@ -248,6 +385,153 @@ func TestVar_Evaluate(t *testing.T) {
 			},
 			wantValue: "2001:db8:85a3:8d3::/64",
 		},
+		{
+			name: "ipv4 prefix of dual-stack",
+			inVar: &Var{
+				Name:  "{http.request.remote.ip_prefix}",
+				Bits:  32,
+				Bits6: 64,
+			},
+			inReq: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/", nil)
+			},
+			wantValue: "192.0.2.1/32",
+		},
+		{
+			name: "ipv6 prefix of dual-stack",
+			inVar: &Var{
+				Name:  "{http.request.remote.ip_prefix}",
+				Bits:  32,
+				Bits6: 64,
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Forwarded-For", "2001:db8:85a3:8d3:1319:8a2e:370:7348")
+				return req
+			},
+			wantValue: "2001:db8:85a3:8d3::/64",
+		},
+		{
+			name: "ipv4-mapped ipv6 prefix of dual-stack",
+			inVar: &Var{
+				Name:  "{http.request.remote.host_prefix}",
+				Bits:  24,
+				Bits6: 64,
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "[::ffff:192.0.2.1]:443"
+				return req
+			},
+			wantValue: "192.0.2.0/24",
+		},
+		{
+			name: "ipv4-mapped ipv6 ip",
+			inVar: &Var{
+				Name: "{http.request.remote.ip}",
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Forwarded-For", "::ffff:192.168.0.1")
+				return req
+			},
+			wantValue: "192.168.0.1",
+		},
+		{
+			name: "jwt claim",
+			inVar: &Var{
+				Name:   "{http.request.jwt}",
+				Field:  "tenant",
+				JWTKey: []byte("secret"),
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Authorization", "Bearer "+newJWT(`{"alg":"HS256"}`, `{"tenant":"t1"}`, hs256("secret")))
+				return req
+			},
+			wantValue: "t1",
+		},
+		{
+			name: "no jwt",
+			inVar: &Var{
+				Name:  "{http.request.jwt}",
+				Field: "tenant",
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Forwarded-For", "10.0.0.1")
+				return req
+			},
+			wantValue: "jwt_invalid:192.0.2.1",
+		},
+		{
+			name: "bad jwt",
+			inVar: &Var{
+				Name:   "{http.request.jwt}",
+				Field:  "tenant",
+				JWTKey: []byte("secret"),
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Authorization", "Bearer "+newJWT(`{"alg":"HS256"}`, `{"tenant":"t1"}`, hs256("wrong")))
+				return req
+			},
+			wantValue: "jwt_invalid:192.0.2.1",
+		},
+		{
+			name: "garbage jwt",
+			inVar: &Var{
+				Name:  "{http.request.jwt}",
+				Field: "tenant",
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Authorization", "Bearer x")
+				return req
+			},
+			wantValue: "jwt_invalid:192.0.2.1",
+		},
+		{
+			name: "jwt without claim",
+			inVar: &Var{
+				Name:  "{http.request.jwt}",
+				Field: "tenant",
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Authorization", "Bearer "+newJWT(`{"alg":"HS256"}`, `{"sub":"u1"}`, hs256("secret")))
+				return req
+			},
+			wantValue: "jwt_invalid:192.0.2.1",
+		},
+		{
+			name: "client certificate subject",
+			inVar: &Var{
+				Name:  "{http.request.tls.client.subject}",
+				Field: "o",
+			},
+			inReq: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.TLS = &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{{
+						Subject: pkix.Name{CommonName: "client1", Organization: []string{"tenant1", "tenant2"}},
+					}},
+				}
+				return req
+			},
+			wantValue: "tenant1,tenant2",
+		},
+		{
+			name: "no client certificate",
+			inVar: &Var{
+				Name:  "{http.request.tls.client.subject}",
+				Field: "cn",
+			},
+			inReq: func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/", nil)
+			},
+			wantValue: "",
+		},
 		{
 			name: "bad ipv4 prefix",
 			inVar: &Var{
@@ -279,3 +563,144 @@ func TestVar_Evaluate(t *testing.T) {
 		})
 	}
 }
+
+func TestVar_EvaluateAddr(t *testing.T) {
+	cases := []struct {
+		in         string
+		inAddr     string
+		wantValue  string
+		wantErrStr string
+	}{
+		{
+			in:        "{remote.ip}",
+			inAddr:    "192.0.2.1:1234",
+			wantValue: "192.0.2.1",
+		},
+		{
+			in:        "{remote.host}",
+			inAddr:    "[::ffff:192.0.2.1]:1234",
+			wantValue: "192.0.2.1",
+		},
+		{
+			in:        "{remote.port}",
+			inAddr:    "192.0.2.1:1234",
+			wantValue: "1234",
+		},
+		{
+			in:        "{remote.ip_prefix.24.64}",
+			inAddr:    "192.0.2.1:1234",
+			wantValue: "192.0.2.0/24",
+		},
+		{
+			in:        "{remote.ip_prefix.24.64}",
+			inAddr:    "[2001:db8:85a3:8d3:1319:8a2e:370:7348]:1234",
+			wantValue: "2001:db8:85a3:8d3::/64",
+		},
+		{
+			in:         "{query.id}",
+			inAddr:     "192.0.2.1:1234",
+			wantErrStr: `unsupported variable for addresses: "{query.id}"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			v, err := ParseVar(c.in)
+			if err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			value, err := v.EvaluateAddr(c.inAddr)
+			if err != nil && err.Error() != c.wantErrStr {
+				t.Fatalf("ErrStr: got (%#v), want (%#v)", err.Error(), c.wantErrStr)
+			}
+			if value != c.wantValue {
+				t.Fatalf("Value: got (%#v), want (%#v)", value, c.wantValue)
+			}
+		})
+	}
+}
+
+func TestRateLimit_Validate(t *testing.T) {
+	cases := []struct {
+		name        string
+		inRateLimit *RateLimit
+		wantErrStr  string
+	}{
+		{
+			name:        "adaptive on private zone",
+			inRateLimit: &RateLimit{Key: "{query.id}", Rate: "2r/m", Adaptive: &Adaptive{ErrorRate: 0.5}},
+			wantErrStr:  "",
+		},
+		{
+			name:        "adaptive on named zone",
+			inRateLimit: &RateLimit{Key: "{query.id}", Rate: "2r/m", ZoneName: "validate", Adaptive: &Adaptive{ErrorRate: 0.5}},
+			wantErrStr:  "adaptive is not supported for a named zone (i.e. with zone_name)",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rl := c.inRateLimit
+			rl.logger = zap.NewNop()
+			if err := rl.provision(); err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+			defer rl.Cleanup()
+
+			errStr := ""
+			if err := rl.Validate(); err != nil {
+				errStr = err.Error()
+			}
+			if errStr != c.wantErrStr {
+				t.Fatalf("Err: got (%#v), want (%#v)", errStr, c.wantErrStr)
+			}
+		})
+	}
+}
+
+func TestRateLimit_logZoneStats(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	rl := &RateLimit{
+		Key:      "{query.id}",
+		Rate:     "2r/m",
+		ZoneSize: 1,
+		logger:   zap.New(core),
+	}
+	if err := rl.provision(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	defer releaseZone(rl.ZoneName, rl.zone)
+
+	stopC := make(chan struct{})
+	go rl.logZoneStats(10*time.Millisecond, stopC)
+	defer close(stopC)
+
+	// Nothing is logged without any eviction or expiration.
+	time.Sleep(30 * time.Millisecond)
+	if n := logs.Len(); n != 0 {
+		t.Fatalf("Logs: got (%#v), want (%#v)", n, 0)
+	}
+
+	// key2 evicts key1.
+	rl.zone.Allow("key1")
+	rl.zone.Allow("key2")
+	time.Sleep(30 * time.Millisecond)
+
+	entries := logs.FilterMessage("zone stats").All()
+	if len(entries) != 1 {
+		t.Fatalf("Logs: got (%#v), want (%#v)", len(entries), 1)
+	}
+	fields := entries[0].ContextMap()
+	if fields["size"] != int64(1) || fields["evictions"] != uint64(1) || fields["expirations"] != uint64(0) {
+		t.Fatalf("Fields: got (%#v)", fields)
+	}
+}
+
+func newRequestWithAuth(auth string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return req
+}
@@ -0,0 +1,331 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// Rules are the rate-limiting rules, which can be loaded from an external
+// JSON or YAML file (see RateLimit.RulesFile).
+type Rules struct {
+	// The variable used to differentiate one client from another.
+	// Defaults to the key of the handler.
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+
+	// The request rate limit (per key value). Defaults to the rate of the
+	// handler. Only the limit can be changed, while the window size (i.e.
+	// r/s or r/m) must be the same as the rate of the handler.
+	Rate string `json:"rate,omitempty" yaml:"rate,omitempty"`
+
+	// The key values that are exempt from rate-limiting. Each one is either
+	// an exact value or a CIDR block (e.g. "10.0.0.0/8"), which matches IP
+	// and CIDR block values within it.
+	Exempt []string `json:"exempt,omitempty" yaml:"exempt,omitempty"`
+
+	// The tiers that apply different rates to specific key values. Tiers are
+	// checked in order, and key values in no tier apply the default rate.
+	Tiers []Tier `json:"tiers,omitempty" yaml:"tiers,omitempty"`
+}
+
+// Tier is a group of key values sharing the same rate.
+type Tier struct {
+	// The unique name of the tier. The states of key values are retained
+	// across reloads as long as the name and the window size of the rate
+	// are not changed.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+
+	// The request rate limit (per key value) of the tier.
+	Rate string `json:"rate,omitempty" yaml:"rate,omitempty"`
+
+	// The key values in the tier. Each one is either an exact value or
+	// a CIDR block.
+	Values []string `json:"values,omitempty" yaml:"values,omitempty"`
+}
+
+// ruleSet is the compiled form of Rules, which is immutable once created.
+type ruleSet struct {
+	keyVar *Var
+	limit  int64
+	exempt *valueSet
+	tiers  []*tier
+}
+
+type tier struct {
+	name   string
+	limit  int64
+	values *valueSet
+	zone   *ShardedZone
+}
+
+// match returns the tier that the given key value is in, or nil if
+// the key value is in no tier.
+func (rs *ruleSet) match(keyValue string) *tier {
+	for _, t := range rs.tiers {
+		if t.values.Contains(keyValue) {
+			return t
+		}
+	}
+	return nil
+}
+
+// release releases the zones of the tiers which are not in keep.
+func (rs *ruleSet) release(keep *ruleSet) {
+	for _, t := range rs.tiers {
+		if kt := keep.tier(t.name); kt == nil || kt.zone != t.zone {
+			_ = t.zone.Destruct()
+		}
+	}
+}
+
+func (rs *ruleSet) tier(name string) *tier {
+	if rs == nil {
+		return nil
+	}
+	for _, t := range rs.tiers {
+		if t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// parseRules parses rules from data, which is in YAML if path has
+// a ".yaml" or ".yml" extension, or in JSON otherwise.
+func parseRules(path string, data []byte) (*Rules, error) {
+	rules := new(Rules)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, rules); err != nil {
+			return nil, err
+		}
+	default:
+		// Reject unknown fields, as yaml.UnmarshalStrict does.
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(rules); err != nil {
+			return nil, err
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("invalid data after the rules")
+		}
+	}
+	return rules, nil
+}
+
+// loadRules loads the rules from the rules file, and applies them atomically.
+func (rl *RateLimit) loadRules() error {
+	info, err := os.Stat(rl.RulesFile)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(rl.RulesFile)
+	if err != nil {
+		return err
+	}
+	rules, err := parseRules(rl.RulesFile, data)
+	if err != nil {
+		return fmt.Errorf("parsing rules file %s: %v", rl.RulesFile, err)
+	}
+
+	old, _ := rl.rules.Load().(*ruleSet)
+	rs, err := rl.compileRules(rules, old)
+	if err != nil {
+		return fmt.Errorf("compiling rules file %s: %v", rl.RulesFile, err)
+	}
+
+	rl.applyRules(rs, old)
+	rl.rulesModTime = info.ModTime()
+	return nil
+}
+
+// compileRules compiles rules into a rule set, reusing the zones of
+// the tiers in old whenever possible.
+func (rl *RateLimit) compileRules(rules *Rules, old *ruleSet) (rs *ruleSet, err error) {
+	rs = new(ruleSet)
+
+	key := rules.Key
+	if key == "" {
+		key = rl.Key
+	}
+	rs.keyVar, err = parseKeyVar(key, rl.JWTKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rate := rules.Rate
+	if rate == "" {
+		rate = rl.Rate
+	}
+	rateSize, rateLimit, err := ParseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	if rateSize != rl.zone.shards[0].rateSize {
+		return nil, fmt.Errorf("the window size of rate %q differs from that of the handler", rate)
+	}
+	rs.limit = int64(rateLimit)
+	if rl.Adaptive != nil && rs.limit < rl.Adaptive.MinLimit {
+		return nil, fmt.Errorf("the limit of rate %q is less than the adaptive min_limit %d", rate, rl.Adaptive.MinLimit)
+	}
+
+	rs.exempt, err = newValueSet(rules.Exempt)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		// Release the zones created just now, if any error occurs.
+		if err != nil {
+			rs.release(old)
+		}
+	}()
+
+	for _, t := range rules.Tiers {
+		if t.Name == "" {
+			return rs, fmt.Errorf("missing tier name")
+		}
+		if rs.tier(t.Name) != nil {
+			return rs, fmt.Errorf("duplicate tier name: %q", t.Name)
+		}
+
+		size, limit, err := ParseRate(t.Rate)
+		if err != nil {
+			return rs, fmt.Errorf("tier %q: %v", t.Name, err)
+		}
+		values, err := newValueSet(t.Values)
+		if err != nil {
+			return rs, fmt.Errorf("tier %q: %v", t.Name, err)
+		}
+
+		var zone *ShardedZone
+		if old != nil {
+			if ot := old.tier(t.Name); ot != nil && ot.zone.shards[0].rateSize == size {
+				zone = ot.zone
+			}
+		}
+		if zone == nil {
+			zone, err = NewShardedZone(rl.ZoneShards, rl.ZoneSize, size, int64(limit), time.Duration(rl.ZoneTTL))
+			if err != nil {
+				return rs, fmt.Errorf("tier %q: %v", t.Name, err)
+			}
+		}
+
+		rs.tiers = append(rs.tiers, &tier{
+			name:   t.Name,
+			limit:  int64(limit),
+			values: values,
+			zone:   zone,
+		})
+	}
+
+	return rs, nil
+}
+
+// applyRules replaces the old rule set with rs. The limits of the reused
+// zones are updated, and the zones no longer used are released.
+func (rl *RateLimit) applyRules(rs, old *ruleSet) {
+	if old == nil || old.limit != rs.limit {
+		rl.zone.SetLimit(rs.limit)
+		if rl.adaptive != nil {
+			rl.adaptive.SetMaxLimit(rs.limit)
+		}
+	}
+	for _, t := range rs.tiers {
+		t.zone.SetLimit(t.limit)
+	}
+
+	rl.rules.Store(rs)
+
+	if old != nil {
+		old.release(rs)
+	}
+}
+
+// watchRules reloads the rules whenever the rules file is modified,
+// until stopC is closed.
+func (rl *RateLimit) watchRules(interval time.Duration, stopC <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(rl.RulesFile)
+			if err != nil {
+				rl.logger.Error("failed to stat rules file", zap.String("file", rl.RulesFile), zap.Error(err))
+				continue
+			}
+			if info.ModTime().Equal(rl.rulesModTime) {
+				continue
+			}
+			if err := rl.loadRules(); err != nil {
+				// Keep using the current rules.
+				rl.logger.Error("failed to reload rules", zap.String("file", rl.RulesFile), zap.Error(err))
+				continue
+			}
+			rl.logger.Info("rules reloaded", zap.String("file", rl.RulesFile))
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// valueSet is a set of key values, each of which is either an exact value
+// or a CIDR block.
+type valueSet struct {
+	values   map[string]struct{}
+	prefixes []netip.Prefix
+}
+
+func newValueSet(values []string) (*valueSet, error) {
+	s := &valueSet{values: make(map[string]struct{})}
+	for _, v := range values {
+		if strings.Contains(v, "/") {
+			if prefix, err := netip.ParsePrefix(v); err == nil {
+				s.prefixes = append(s.prefixes, prefix.Masked())
+				continue
+			}
+		}
+		if v == "" {
+			return nil, fmt.Errorf("empty value")
+		}
+		s.values[v] = struct{}{}
+	}
+	return s, nil
+}
+
+// Contains reports whether v is in the set. If v is an IP or a CIDR block,
+// it is also checked against the CIDR blocks in the set.
+func (s *valueSet) Contains(v string) bool {
+	if _, ok := s.values[v]; ok {
+		return true
+	}
+	if len(s.prefixes) == 0 {
+		return false
+	}
+
+	var addr netip.Addr
+	bits := -1
+	if prefix, err := netip.ParsePrefix(v); err == nil {
+		addr, bits = prefix.Addr(), prefix.Bits()
+	} else if addr, err = netip.ParseAddr(v); err != nil {
+		return false
+	}
+
+	for _, p := range s.prefixes {
+		if p.Contains(addr) && (bits < 0 || bits >= p.Bits()) {
+			return true
+		}
+	}
+	return false
+}
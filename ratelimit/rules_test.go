@@ -0,0 +1,198 @@
+package ratelimit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestParseRules(t *testing.T) {
+	want := &Rules{
+		Key:    "{query.id}",
+		Rate:   "2r/m",
+		Exempt: []string{"admin", "10.0.0.0/8"},
+		Tiers: []Tier{
+			{Name: "premium", Rate: "10r/m", Values: []string{"vip"}},
+		},
+	}
+
+	cases := []struct {
+		inPath string
+		inData string
+	}{
+		{
+			inPath: "rules.json",
+			inData: `{"key":"{query.id}","rate":"2r/m","exempt":["admin","10.0.0.0/8"],"tiers":[{"name":"premium","rate":"10r/m","values":["vip"]}]}`,
+		},
+		{
+			inPath: "rules.yaml",
+			inData: `
+key: "{query.id}"
+rate: 2r/m
+exempt: [admin, 10.0.0.0/8]
+tiers:
+  - name: premium
+    rate: 10r/m
+    values: [vip]
+`,
+		},
+	}
+
+	for _, c := range cases {
+		got, err := parseRules(c.inPath, []byte(c.inData))
+		if err != nil {
+			t.Fatalf("%s: Err: %v", c.inPath, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: Rules: got (%#v), want (%#v)", c.inPath, got, want)
+		}
+	}
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	cases := []struct {
+		inPath     string
+		inData     string
+		wantErrStr string
+	}{
+		{
+			inPath:     "rules.json",
+			inData:     `{"key":"{query.id}","rates":"2r/m"}`,
+			wantErrStr: `json: unknown field "rates"`,
+		},
+		{
+			inPath:     "rules.json",
+			inData:     `{"key":"{query.id}"} {}`,
+			wantErrStr: "invalid data after the rules",
+		},
+		{
+			inPath:     "rules.yaml",
+			inData:     "key: \"{query.id}\"\nrates: 2r/m\n",
+			wantErrStr: "yaml: unmarshal errors:\n  line 2: field rates not found in type ratelimit.Rules",
+		},
+	}
+
+	for _, c := range cases {
+		_, err := parseRules(c.inPath, []byte(c.inData))
+		if err == nil || err.Error() != c.wantErrStr {
+			t.Fatalf("%s: Err: got (%v), want (%#v)", c.inPath, err, c.wantErrStr)
+		}
+	}
+}
+
+func TestValueSet_Contains(t *testing.T) {
+	s, _ := newValueSet([]string{"admin", "10.0.0.0/8", "2001:db8::/32"})
+
+	cases := []struct {
+		in   string
+		want bool
+	}{
+		{"admin", true},
+		{"user", false},
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"10.1.0.0/16", true},
+		{"10.0.0.0/7", false},
+		{"2001:db8::1", true},
+		{"2001:db8::/48", true},
+		{"2001:db9::1", false},
+	}
+
+	for _, c := range cases {
+		if got := s.Contains(c.in); got != c.want {
+			t.Fatalf("Contains(%q): got (%#v), want (%#v)", c.in, got, c.want)
+		}
+	}
+}
+
+func TestRateLimit_loadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ratelimit")
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.yaml")
+	writeRules := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+	}
+
+	writeRules(`
+rate: 1r/m
+exempt: [admin]
+tiers:
+  - name: premium
+    rate: 2r/m
+    values: [vip]
+`)
+	rl := &RateLimit{
+		Key:       "{query.id}",
+		Rate:      "5r/m",
+		RulesFile: path,
+		logger:    zap.NewNop(),
+	}
+	if err := rl.provision(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	defer rl.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	serve := func(ids ...string) (statusCodes []int) {
+		for _, id := range ids {
+			r := httptest.NewRequest(http.MethodGet, "/foo?id="+id, nil)
+			repl := caddyhttp.NewTestReplacer(r)
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+			w := httptest.NewRecorder()
+			_ = rl.ServeHTTP(w, r, next)
+			statusCodes = append(statusCodes, w.Result().StatusCode)
+		}
+		return
+	}
+
+	got := serve("user", "user", "vip", "vip", "vip", "admin", "admin", "admin")
+	want := []int{200, 429, 200, 200, 429, 200, 200, 200}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("StatusCodes: got (%#v), want (%#v)", got, want)
+	}
+
+	// Raising the limits keeps the states of the existing key values.
+	writeRules(`
+rate: 2r/m
+tiers:
+  - name: premium
+    rate: 3r/m
+    values: [vip]
+`)
+	if err := rl.loadRules(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	got = serve("user", "user", "vip", "vip", "admin", "admin", "admin")
+	want = []int{200, 429, 200, 429, 200, 200, 429}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("StatusCodes: got (%#v), want (%#v)", got, want)
+	}
+
+	// Invalid rules are rejected, and the current ones are kept.
+	writeRules(`rate: 2r/s`)
+	if err := rl.loadRules(); err == nil {
+		t.Fatalf("Err: got (nil), want (non-nil)")
+	}
+	if got := rl.zone.Limit(); got != 2 {
+		t.Fatalf("Limit: got (%#v), want (%#v)", got, 2)
+	}
+}
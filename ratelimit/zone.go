@@ -1,30 +1,100 @@
 package ratelimit
 
 import (
-	"time"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	sw "github.com/RussellLuo/slidingwindow"
+	"github.com/caddyserver/caddy/v2"
 	"github.com/hashicorp/golang-lru"
 )
 
+// entry is the value kept in the zone for each key.
+type entry struct {
+	lim *sw.Limiter
+
+	// mu serializes all the uses of lim, so that Peek can check the quota
+	// atomically.
+	mu sync.Mutex
+
+	// lastSeen is the Unix time (in nanoseconds) when the limiter was
+	// last used. It must be accessed atomically.
+	lastSeen int64
+
+	// limit is the limit last applied to the limiter. It must be
+	// accessed atomically.
+	limit int64
+}
+
+// ZoneStats holds the statistics of a zone.
+type ZoneStats struct {
+	// The number of keys currently kept in the zone.
+	Size int
+	// The number of keys evicted because the zone was full.
+	Evictions uint64
+	// The number of keys removed because they had been idle for too long.
+	Expirations uint64
+}
+
 type Zone struct {
 	limiters *lru.Cache
 
 	rateSize  time.Duration
 	rateLimit int64
+
+	// The effective limit, which defaults to rateLimit and may be changed
+	// by SetLimit. It must be accessed atomically.
+	limit int64
+
+	// The idle duration after which a key will be removed from the zone.
+	// Zero means that keys never expire.
+	ttl time.Duration
+
+	evictions   uint64
+	expirations uint64
+
+	now      func() time.Time
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+// newLocalLimiter creates a limiter whose states are only stored in memory.
+func newLocalLimiter(rateSize time.Duration, rateLimit int64) *sw.Limiter {
+	lim, _ := sw.NewLimiter(rateSize, rateLimit, func() (sw.Window, sw.StopFunc) {
+		// NewLocalWindow returns an empty stop function, so it's
+		// unnecessary to call it later.
+		return sw.NewLocalWindow()
+	})
+	return lim
 }
 
 func NewZone(size int, rateSize time.Duration, rateLimit int64) (*Zone, error) {
+	return NewZoneWithTTL(size, rateSize, rateLimit, 0)
+}
+
+// NewZoneWithTTL is like NewZone, but additionally removes keys that have
+// been idle for longer than ttl. The expired keys are swept periodically
+// in the background, until Stop is called.
+func NewZoneWithTTL(size int, rateSize time.Duration, rateLimit int64, ttl time.Duration) (*Zone, error) {
 	cache, err := lru.New(size)
 	if err != nil {
 		return nil, err
 	}
-	return &Zone{
+	z := &Zone{
 		limiters:  cache,
 		rateSize:  rateSize,
 		rateLimit: rateLimit,
-	}, nil
+		limit:     rateLimit,
+		ttl:       ttl,
+		now:       time.Now,
+		stopC:     make(chan struct{}),
+	}
+	if ttl > 0 {
+		go z.sweepLoop(sweepInterval(ttl))
+	}
+	return z, nil
 }
 
 // Purge is used to completely clear the zone.
@@ -32,36 +102,326 @@ func (z *Zone) Purge() {
 	z.limiters.Purge()
 }
 
+// Stop stops the background sweeper, if any.
+func (z *Zone) Stop() {
+	z.stopOnce.Do(func() {
+		close(z.stopC)
+	})
+}
+
+// Stats returns the current statistics of the zone.
+func (z *Zone) Stats() ZoneStats {
+	return ZoneStats{
+		Size:        z.limiters.Len(),
+		Evictions:   atomic.LoadUint64(&z.evictions),
+		Expirations: atomic.LoadUint64(&z.expirations),
+	}
+}
+
+// Limit returns the effective limit of the zone.
+func (z *Zone) Limit() int64 {
+	return atomic.LoadInt64(&z.limit)
+}
+
+// SetLimit changes the effective limit of the zone, which will be applied
+// to the limiters of all keys lazily (i.e. when they are used next time).
+func (z *Zone) SetLimit(limit int64) {
+	atomic.StoreInt64(&z.limit, limit)
+}
+
 func (z *Zone) Allow(key string) bool {
-	lim, _, _ := z.getLimiter(key)
-	return lim.Allow()
+	e, _, _ := z.getEntry(key)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lim.Allow()
+}
+
+// Contains reports whether there is a limiter for key in the zone.
+func (z *Zone) Contains(key string) bool {
+	return z.limiters.Contains(key)
+}
+
+// Peek reports whether an event for key would be allowed now, without
+// consuming the quota of key.
+func (z *Zone) Peek(key string) bool {
+	elem, ok := z.limiters.Peek(key)
+	if !ok {
+		// There is no limiter for key yet, which is equivalent to
+		// having a limiter with the full quota.
+		return z.Limit() > 0
+	}
+
+	e := elem.(*entry)
+	lim := z.syncLimit(e)
+
+	// The limiter has no read-only check, so borrow one event and give it
+	// back. This is done under the lock of the entry, thus concurrent events
+	// never see the borrowed one.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := z.now()
+	if !lim.AllowN(now, 1) {
+		return false
+	}
+	lim.AllowN(now, -1)
+	return true
 }
 
 func (z *Zone) RateLimitPolicyHeader() string {
-	return fmt.Sprintf("%d; w=%d", z.rateLimit, int(z.rateSize.Seconds()))
+	return fmt.Sprintf("%d; w=%d", z.Limit(), int(z.rateSize.Seconds()))
+}
+
+// syncLimit applies the effective limit of the zone to the limiter in e,
+// if it has been changed, and returns the limiter.
+func (z *Zone) syncLimit(e *entry) *sw.Limiter {
+	limit := z.Limit()
+	if atomic.LoadInt64(&e.limit) != limit {
+		e.lim.SetLimit(limit)
+		atomic.StoreInt64(&e.limit, limit)
+	}
+	return e.lim
 }
 
-func (z *Zone) getLimiter(key string) (lim *sw.Limiter, ok, evict bool) {
+func (z *Zone) getEntry(key string) (e *entry, ok, evict bool) {
+	now := z.now().UnixNano()
+
 	// If there is already a limiter for key, just return it.
-	elem, ok := z.limiters.Peek(key)
+	//
+	// Note that we use Get (instead of Peek) to mark the key as recently
+	// used, thus active keys will not be evicted in favor of idle ones.
+	elem, ok := z.limiters.Get(key)
 	if ok {
-		return elem.(*sw.Limiter), true, false
+		e = elem.(*entry)
+		atomic.StoreInt64(&e.lastSeen, now)
+		z.syncLimit(e)
+		return e, true, false
 	}
 
-	lim, _ = sw.NewLimiter(z.rateSize, z.rateLimit, func() (sw.Window, sw.StopFunc) {
-		// NewLocalWindow returns an empty stop function, so it's
-		// unnecessary to call it later.
-		return sw.NewLocalWindow()
-	})
-	// Try to add lim as the limiter for key.
-	ok, evict = z.limiters.ContainsOrAdd(key, lim)
+	limit := z.Limit()
+	e = &entry{lim: newLocalLimiter(z.rateSize, limit), lastSeen: now, limit: limit}
+	// Try to add e as the entry for key.
+	ok, evict = z.limiters.ContainsOrAdd(key, e)
+	if evict {
+		atomic.AddUint64(&z.evictions, 1)
+	}
 
 	if ok {
-		// The limiter for key has been added by someone else just now.
-		// We should use the limiter rather than our lim.
+		// The entry for key has been added by someone else just now.
+		// We should use the entry rather than our e.
 		elem, _ = z.limiters.Peek(key)
-		lim = elem.(*sw.Limiter)
+		e = elem.(*entry)
+		z.syncLimit(e)
 	}
 
 	return
 }
+
+func (z *Zone) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			z.sweep()
+		case <-z.stopC:
+			return
+		}
+	}
+}
+
+// sweep removes all the keys that have been idle for longer than the TTL,
+// and returns the number of removed keys.
+func (z *Zone) sweep() (n int) {
+	deadline := z.now().Add(-z.ttl).UnixNano()
+
+	for _, key := range z.limiters.Keys() {
+		elem, ok := z.limiters.Peek(key)
+		if !ok {
+			// Already evicted.
+			continue
+		}
+		if atomic.LoadInt64(&elem.(*entry).lastSeen) > deadline {
+			continue
+		}
+		// The key may be used again just before its removal, which is
+		// harmless since the client will simply get a fresh limiter.
+		z.limiters.Remove(key)
+		n++
+	}
+
+	atomic.AddUint64(&z.expirations, uint64(n))
+	return n
+}
+
+// sweepInterval returns the interval between two sweeps for the given TTL.
+func sweepInterval(ttl time.Duration) time.Duration {
+	interval := ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// zones holds all the named zones, which are shared among handlers and
+// matchers with the same zone name and zone settings, and survive config
+// reloads.
+var zones = caddy.NewUsagePool()
+
+// zoneKey returns the key of the named zone in zones. The zone settings are
+// part of the key, so changing any of them (e.g. in a config reload) creates
+// a new zone instead of failing with the one still held by the old config.
+func zoneKey(name string, shards, size int, rateSize time.Duration, rateLimit int64, ttl time.Duration) string {
+	return fmt.Sprintf("%s/%d/%d/%v/%d/%v", name, shards, size, rateSize, rateLimit, ttl)
+}
+
+// loadOrNewZone returns the zone with the given name and settings, or
+// creates one if not found. If name is empty, a new private zone will
+// always be created. The returned zone must be released by calling
+// releaseZone.
+func loadOrNewZone(name string, shards, size int, rateSize time.Duration, rateLimit int64, ttl time.Duration) (*ShardedZone, error) {
+	if name == "" {
+		return NewShardedZone(shards, size, rateSize, rateLimit, ttl)
+	}
+
+	val, _, err := zones.LoadOrNew(zoneKey(name, shards, size, rateSize, rateLimit, ttl), func() (caddy.Destructor, error) {
+		return NewShardedZone(shards, size, rateSize, rateLimit, ttl)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sz := val.(*ShardedZone)
+	// A named zone is never adapted (see RateLimit.Validate), but reset the
+	// effective limit anyway, so that it always starts from the configured
+	// rate after a reload.
+	sz.SetLimit(rateLimit)
+	return sz, nil
+}
+
+// releaseZone releases the zone, which is returned by loadOrNewZone.
+func releaseZone(name string, sz *ShardedZone) {
+	if name == "" {
+		_ = sz.Destruct()
+		return
+	}
+	z := sz.shards[0]
+	_, _ = zones.Delete(zoneKey(name, len(sz.shards), sz.size, z.rateSize, z.rateLimit, z.ttl))
+}
+
+// ShardedZone is a zone whose keys are spread over multiple independent
+// shards (each of which is a Zone), to reduce lock contention under high
+// concurrency.
+type ShardedZone struct {
+	shards []*Zone
+	size   int
+}
+
+// NewShardedZone creates a zone with n shards. The size is divided evenly
+// among all the shards, and each shard holds at least one key.
+func NewShardedZone(n, size int, rateSize time.Duration, rateLimit int64, ttl time.Duration) (*ShardedZone, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of shards: %d", n)
+	}
+
+	shardSize := (size + n - 1) / n
+	if shardSize < 1 {
+		shardSize = 1
+	}
+
+	sz := &ShardedZone{shards: make([]*Zone, n), size: size}
+	for i := range sz.shards {
+		zone, err := NewZoneWithTTL(shardSize, rateSize, rateLimit, ttl)
+		if err != nil {
+			sz.Stop()
+			return nil, err
+		}
+		sz.shards[i] = zone
+	}
+	return sz, nil
+}
+
+// Purge is used to completely clear all the shards.
+func (sz *ShardedZone) Purge() {
+	for _, zone := range sz.shards {
+		zone.Purge()
+	}
+}
+
+// Stop stops the background sweepers of all the shards.
+func (sz *ShardedZone) Stop() {
+	for _, zone := range sz.shards {
+		if zone != nil {
+			zone.Stop()
+		}
+	}
+}
+
+// Destruct implements caddy.Destructor.
+func (sz *ShardedZone) Destruct() error {
+	sz.Stop()
+	sz.Purge()
+	return nil
+}
+
+// Stats returns the statistics aggregated from all the shards.
+func (sz *ShardedZone) Stats() (stats ZoneStats) {
+	for _, zone := range sz.shards {
+		s := zone.Stats()
+		stats.Size += s.Size
+		stats.Evictions += s.Evictions
+		stats.Expirations += s.Expirations
+	}
+	return stats
+}
+
+// Limit returns the effective limit of the zone.
+func (sz *ShardedZone) Limit() int64 {
+	return sz.shards[0].Limit()
+}
+
+// SetLimit changes the effective limit of all the shards.
+func (sz *ShardedZone) SetLimit(limit int64) {
+	for _, zone := range sz.shards {
+		zone.SetLimit(limit)
+	}
+}
+
+func (sz *ShardedZone) Allow(key string) bool {
+	return sz.shard(key).Allow(key)
+}
+
+func (sz *ShardedZone) Contains(key string) bool {
+	return sz.shard(key).Contains(key)
+}
+
+func (sz *ShardedZone) Peek(key string) bool {
+	return sz.shard(key).Peek(key)
+}
+
+func (sz *ShardedZone) RateLimitPolicyHeader() string {
+	return sz.shards[0].RateLimitPolicyHeader()
+}
+
+// shard returns the shard that the given key belongs to.
+func (sz *ShardedZone) shard(key string) *Zone {
+	if len(sz.shards) == 1 {
+		return sz.shards[0]
+	}
+	return sz.shards[fnv32a(key)%uint32(len(sz.shards))]
+}
+
+// fnv32a returns the 32-bit FNV-1a hash of s. It is inlined here to
+// avoid the allocations of hash/fnv.
+func fnv32a(s string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= prime32
+	}
+	return h
+}
@@ -1,13 +1,17 @@
 package ratelimit
 
 import (
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	sw "github.com/RussellLuo/slidingwindow"
 )
 
-func TestZone_getLimiter(t *testing.T) {
+func TestZone_getEntry(t *testing.T) {
 	zone, _ := NewZone(2, time.Second, 10)
 
 	cases := []struct {
@@ -22,9 +26,9 @@ func TestZone_getLimiter(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		lim, ok, evict := zone.getLimiter(c.key)
-		if lim == nil {
-			t.Fatalf("Limiter is nil")
+		e, ok, evict := zone.getEntry(c.key)
+		if e == nil {
+			t.Fatalf("Entry is nil")
 		}
 
 		if ok != c.ok {
@@ -37,7 +41,7 @@ func TestZone_getLimiter(t *testing.T) {
 	}
 }
 
-func TestZone_getLimiterConcurrently(t *testing.T) {
+func TestZone_getEntryConcurrently(t *testing.T) {
 	test := func(n int) {
 		zone, _ := NewZone(1, time.Second, 10)
 		key := "key1"
@@ -47,8 +51,8 @@ func TestZone_getLimiterConcurrently(t *testing.T) {
 		for i := 0; i < n; i++ {
 			go func() {
 				<-startC
-				lim, _, _ := zone.getLimiter(key)
-				limC <- lim
+				e, _, _ := zone.getEntry(key)
+				limC <- e.lim
 			}()
 		}
 
@@ -65,7 +69,7 @@ func TestZone_getLimiterConcurrently(t *testing.T) {
 		if !ok {
 			t.Fatalf("Found no limiter")
 		}
-		wantLim := elem.(*sw.Limiter)
+		wantLim := elem.(*entry).lim
 
 		for _, lim := range gotLims {
 			if lim != wantLim {
@@ -89,3 +93,241 @@ func TestZone_getLimiterConcurrently(t *testing.T) {
 		})
 	}
 }
+
+func TestZone_sweep(t *testing.T) {
+	zone, _ := NewZone(10, time.Second, 10)
+	zone.ttl = time.Minute
+
+	now := time.Now()
+	zone.now = func() time.Time { return now }
+
+	zone.Allow("key1")
+	zone.Allow("key2")
+
+	// Only key2 is used again after 30 seconds.
+	now = now.Add(30 * time.Second)
+	zone.Allow("key2")
+
+	cases := []struct {
+		elapsed  time.Duration
+		wantN    int
+		wantKeys []string
+	}{
+		{0, 0, []string{"key1", "key2"}},
+		{30 * time.Second, 1, []string{"key2"}},
+		{30 * time.Second, 1, nil},
+	}
+
+	for _, c := range cases {
+		now = now.Add(c.elapsed)
+		n := zone.sweep()
+		if n != c.wantN {
+			t.Fatalf("N: got (%#v), want (%#v)", n, c.wantN)
+		}
+
+		var keys []string
+		for _, k := range zone.limiters.Keys() {
+			keys = append(keys, k.(string))
+		}
+		if !reflect.DeepEqual(keys, c.wantKeys) {
+			t.Fatalf("Keys: got (%#v), want (%#v)", keys, c.wantKeys)
+		}
+	}
+
+	stats := zone.Stats()
+	if stats.Expirations != 2 {
+		t.Fatalf("Expirations: got (%#v), want (%#v)", stats.Expirations, 2)
+	}
+}
+
+func TestZone_Stats(t *testing.T) {
+	zone, _ := NewZone(2, time.Second, 10)
+	for _, key := range []string{"key1", "key2", "key1", "key3"} {
+		zone.Allow(key)
+	}
+
+	// key1 was used recently, so key2 (instead of key1) was evicted by key3.
+	if !zone.limiters.Contains("key1") || zone.limiters.Contains("key2") {
+		t.Fatalf("Keys: got (%#v)", zone.limiters.Keys())
+	}
+
+	want := ZoneStats{Size: 2, Evictions: 1}
+	if got := zone.Stats(); got != want {
+		t.Fatalf("Stats: got (%#v), want (%#v)", got, want)
+	}
+}
+
+func TestShardedZone(t *testing.T) {
+	zone, _ := NewShardedZone(4, 10, time.Second, 1, 0)
+
+	if n := len(zone.shards); n != 4 {
+		t.Fatalf("Shards: got (%#v), want (%#v)", n, 4)
+	}
+	for _, shard := range zone.shards {
+		if size := shard.limiters.Len(); size != 0 {
+			t.Fatalf("Size: got (%#v), want (%#v)", size, 0)
+		}
+	}
+
+	keys := []string{"key1", "key2", "key3", "key4", "key5"}
+	for _, key := range keys {
+		if !zone.Allow(key) {
+			t.Fatalf("Allow(%q): got (false), want (true)", key)
+		}
+		// The same key always goes to the same shard.
+		if zone.Allow(key) {
+			t.Fatalf("Allow(%q): got (true), want (false)", key)
+		}
+	}
+
+	if size := zone.Stats().Size; size != len(keys) {
+		t.Fatalf("Size: got (%#v), want (%#v)", size, len(keys))
+	}
+
+	if _, err := NewShardedZone(0, 10, time.Second, 1, 0); err == nil {
+		t.Fatalf("Err: got (nil), want (non-nil)")
+	}
+}
+
+func BenchmarkZone_Allow(b *testing.B) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+
+	cases := []struct {
+		name   string
+		shards int
+	}{
+		{"shards-1", 1},
+		{"shards-8", 8},
+		{"shards-32", 32},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			// Leave enough room for all the keys, since they may not be
+			// spread evenly over the shards.
+			zone, _ := NewShardedZone(c.shards, 2*len(keys), time.Second, 100, 0)
+			var seed uint32
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint32(&seed, 7919))
+				for pb.Next() {
+					zone.Allow(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestZone_Peek(t *testing.T) {
+	zone, _ := NewZone(10, time.Minute, 2)
+
+	cases := []struct {
+		allow    bool // call Allow (or Peek if false)
+		wantPass bool
+	}{
+		{false, true},
+		{true, true},
+		{false, true},
+		{false, true},
+		{true, true},
+		{false, false},
+		{true, false},
+	}
+
+	for i, c := range cases {
+		var pass bool
+		if c.allow {
+			pass = zone.Allow("key1")
+		} else {
+			pass = zone.Peek("key1")
+		}
+		if pass != c.wantPass {
+			t.Fatalf("#%d: got (%#v), want (%#v)", i, pass, c.wantPass)
+		}
+	}
+}
+
+func TestLoadOrNewZone(t *testing.T) {
+	z1, err := loadOrNewZone("test", 1, 10, time.Minute, 2, 0)
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	z2, err := loadOrNewZone("test", 1, 10, time.Minute, 2, 0)
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if z1 != z2 {
+		t.Fatalf("Zone: got different zones with the same name")
+	}
+
+	// Changing any of the settings results in a different zone.
+	z3, err := loadOrNewZone("test", 1, 10, time.Second, 2, 0)
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if z3 == z1 {
+		t.Fatalf("Zone: got the same zone with different settings")
+	}
+	releaseZone("test", z3)
+
+	// The effective limit is reset to the configured rate.
+	z1.SetLimit(1)
+	z4, err := loadOrNewZone("test", 1, 10, time.Minute, 2, 0)
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if z4 != z1 || z4.Limit() != 2 {
+		t.Fatalf("Limit: got (%#v), want (%#v)", z4.Limit(), int64(2))
+	}
+	releaseZone("test", z4)
+
+	releaseZone("test", z1)
+	releaseZone("test", z2)
+
+	z5, _ := loadOrNewZone("test", 1, 10, time.Minute, 2, 0)
+	if z5 == z1 {
+		t.Fatalf("Zone: got the released zone")
+	}
+	releaseZone("test", z5)
+}
+
+func TestZone_PeekConcurrently(t *testing.T) {
+	const n = 1000
+	zone, _ := NewZone(10, time.Minute, n)
+
+	stopC := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stopC:
+				return
+			default:
+				zone.Peek("key1")
+			}
+		}
+	}()
+	defer close(stopC)
+
+	// Peek must never make concurrent events see a borrowed token.
+	var wg sync.WaitGroup
+	var allowed int64
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if zone.Allow("key1") {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != n {
+		t.Fatalf("Allowed: got (%#v), want (%#v)", allowed, n)
+	}
+}
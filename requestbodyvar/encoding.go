@@ -0,0 +1,109 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	// errUnsupportedEncoding is returned by decodeBody for unsupported
+	// Content-Encoding values.
+	errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+	// errDecodedBodyTooLarge is returned by decodeBody if the decoded body
+	// is too large.
+	errDecodedBodyTooLarge = errors.New("decoded body too large")
+	// errCorruptBody is returned by decodeBody if the body fails to be
+	// decoded.
+	errCorruptBody = errors.New("corrupt body")
+)
+
+// decodeBody decodes the body buffered in buf according to the value of
+// the Content-Encoding header. If maxSize is positive, an error will be
+// returned once the decoded body is larger than maxSize.
+//
+// Note that buf is left intact, and it is returned as is if there is no
+// encoding to decode.
+func decodeBody(buf *bytes.Buffer, contentEncoding string, maxSize int64) (*bytes.Buffer, error) {
+	var encodings []string
+	for _, enc := range strings.Split(contentEncoding, ",") {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if enc != "" && enc != "identity" {
+			encodings = append(encodings, enc)
+		}
+	}
+	if len(encodings) == 0 {
+		return buf, nil
+	}
+
+	data := buf.Bytes()
+	// Encodings are listed in the order in which they were applied,
+	// so decode them in the reverse order.
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, err := newDecoder(encodings[i], bytes.NewReader(data))
+		if errors.Is(err, errUnsupportedEncoding) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: decoding %s: %v", errCorruptBody, encodings[i], err)
+		}
+
+		var src io.Reader = r
+		if maxSize > 0 {
+			src = io.LimitReader(r, maxSize+1)
+		}
+		decoded, err := ioutil.ReadAll(src)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: decoding %s: %v", errCorruptBody, encodings[i], err)
+		}
+		if maxSize > 0 && int64(len(decoded)) > maxSize {
+			return nil, fmt.Errorf("%w: > %d", errDecodedBodyTooLarge, maxSize)
+		}
+		data = decoded
+	}
+
+	return bytes.NewBuffer(data), nil
+}
+
+// bodyErrorStatus returns the HTTP status code for err returned by
+// decodeBody or newQuerier.
+func bodyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errDecodedBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errCorruptBody):
+		return http.StatusBadRequest
+	default:
+		// Unsupported encodings or media types.
+		return http.StatusUnsupportedMediaType
+	}
+}
+
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "br":
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedEncoding, encoding)
+	}
+}
@@ -0,0 +1,131 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func encode(t *testing.T, data string, newWriter func(w io.Writer) io.WriteCloser) string {
+	var buf bytes.Buffer
+	w := newWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	return buf.String()
+}
+
+func TestDecodeBody(t *testing.T) {
+	gzipWriter := func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	zlibWriter := func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }
+	brotliWriter := func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }
+	zstdWriter := func(w io.Writer) io.WriteCloser {
+		enc, _ := zstd.NewWriter(w)
+		return enc
+	}
+
+	body := `{"name":"caddy"}`
+
+	cases := []struct {
+		name       string
+		inBody     string
+		inEncoding string
+		inMaxSize  int64
+		want       string
+		wantErrStr string
+	}{
+		{
+			name:   "no encoding",
+			inBody: body,
+			want:   body,
+		},
+		{
+			name:       "identity",
+			inBody:     body,
+			inEncoding: "identity",
+			want:       body,
+		},
+		{
+			name:       "gzip",
+			inBody:     encode(t, body, gzipWriter),
+			inEncoding: "gzip",
+			want:       body,
+		},
+		{
+			name:       "deflate",
+			inBody:     encode(t, body, zlibWriter),
+			inEncoding: "deflate",
+			want:       body,
+		},
+		{
+			name:       "br",
+			inBody:     encode(t, body, brotliWriter),
+			inEncoding: "br",
+			want:       body,
+		},
+		{
+			name:       "zstd",
+			inBody:     encode(t, body, zstdWriter),
+			inEncoding: "zstd",
+			want:       body,
+		},
+		{
+			name:       "multiple encodings",
+			inBody:     encode(t, encode(t, body, gzipWriter), brotliWriter),
+			inEncoding: "gzip, br",
+			want:       body,
+		},
+		{
+			name:       "within max size",
+			inBody:     encode(t, body, gzipWriter),
+			inEncoding: "gzip",
+			inMaxSize:  int64(len(body)),
+			want:       body,
+		},
+		{
+			name:       "over max size",
+			inBody:     encode(t, body, gzipWriter),
+			inEncoding: "gzip",
+			inMaxSize:  int64(len(body)) - 1,
+			wantErrStr: "decoded body too large: > 15",
+		},
+		{
+			name:       "unsupported encoding",
+			inBody:     body,
+			inEncoding: "compress",
+			wantErrStr: `unsupported Content-Encoding: "compress"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := bytes.NewBufferString(c.inBody)
+			got, err := decodeBody(buf, c.inEncoding, c.inMaxSize)
+			if err != nil {
+				if err.Error() != c.wantErrStr {
+					t.Fatalf("ErrStr: got (%#v), want (%#v)", err.Error(), c.wantErrStr)
+				}
+				return
+			}
+			if c.wantErrStr != "" {
+				t.Fatalf("ErrStr: got (nil), want (%#v)", c.wantErrStr)
+			}
+
+			if got.String() != c.want {
+				t.Fatalf("Body: got (%#v), want (%#v)", got.String(), c.want)
+			}
+			// The original body must be left intact.
+			if buf.String() != c.inBody {
+				t.Fatalf("Original body: got (%#v), want (%#v)", buf.String(), c.inBody)
+			}
+		})
+	}
+}
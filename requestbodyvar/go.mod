@@ -3,10 +3,23 @@ module github.com/RussellLuo/caddy-ext/requestbodyvar
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/PaesslerAG/gval v1.0.0
+	github.com/PaesslerAG/jsonpath v0.1.1
+	github.com/andybalholm/brotli v1.0.3
 	github.com/basgys/goxml2json v1.1.0
 	github.com/bitly/go-simplejson v0.5.0 // indirect
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
 	github.com/caddyserver/caddy/v2 v2.4.5
+	github.com/dustin/go-humanize v1.0.1-0.20200219035652-afde56e7acac
+	github.com/jmespath/go-jmespath v0.4.0
+	github.com/klauspost/compress v1.13.4
+	github.com/santhosh-tekuri/jsonschema/v5 v5.0.0
 	github.com/tidwall/gjson v1.6.7
+	github.com/tidwall/sjson v1.0.4
+	github.com/vektah/gqlparser/v2 v2.2.0
+	github.com/vmihailenco/msgpack/v5 v5.3.4
 	go.uber.org/zap v1.19.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,214 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+const graphqlKeyPrefix = "graphql."
+
+// maxGraphQLSelections is the maximum number of selections walked in
+// a GraphQL document, where the selections of each fragment are counted
+// only once.
+const maxGraphQLSelections = 10000
+
+// GraphQL queries the information of the GraphQL operation in a request,
+// which is parsed once at the first query. The supported keys are:
+//
+// - `graphql.operation_name`: the name of the operation.
+// - `graphql.operation_type`: the type of the operation, i.e. `query`, `mutation` or `subscription`.
+// - `graphql.depth`: the maximum depth of the selection sets, with fragments expanded.
+// - `graphql.root_fields`: the comma-separated names of the root fields, with fragments expanded.
+//
+// If the document contains multiple operations, the one specified by
+// the operation name is used. A document with more than 10,000 selections
+// (with each fragment counted once) is regarded as invalid.
+type GraphQL struct {
+	query         string
+	operationName string
+
+	once sync.Once
+	info map[string]string
+}
+
+func (g *GraphQL) Query(key string) string {
+	if !strings.HasPrefix(key, graphqlKeyPrefix) {
+		return ""
+	}
+	g.once.Do(func() {
+		g.info = parseGraphQL(g.query, g.operationName)
+	})
+	return g.info[key[len(graphqlKeyPrefix):]]
+}
+
+// newGraphQLFromJSON creates a querier from a GraphQL request in the JSON
+// envelope (i.e. `{"query": "...", "operationName": "...", "variables": {...}}`),
+// which is buffered in buf. It returns nil if the body is not such one.
+func newGraphQLFromJSON(buf *bytes.Buffer) *GraphQL {
+	query := gjson.GetBytes(buf.Bytes(), "query")
+	if query.Type != gjson.String {
+		return nil
+	}
+	return &GraphQL{
+		query:         query.String(),
+		operationName: gjson.GetBytes(buf.Bytes(), "operationName").String(),
+	}
+}
+
+// parseGraphQL parses the query document, and returns the information of
+// the selected operation. It returns nil if the document is invalid or no
+// operation is selected.
+func parseGraphQL(query, operationName string) map[string]string {
+	doc, err := parser.ParseQuery(&ast.Source{Input: query})
+	if err != nil {
+		return nil
+	}
+	op := doc.Operations.ForName(operationName)
+	if op == nil {
+		return nil
+	}
+
+	w := &graphqlWalker{
+		fragments:  doc.Fragments,
+		visiting:   make(map[string]bool),
+		depths:     make(map[string]int),
+		fieldNames: make(map[string][]string),
+		budget:     maxGraphQLSelections,
+	}
+	var rootFields []string
+	seen := make(map[string]bool)
+	w.fields(op.SelectionSet, func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			rootFields = append(rootFields, name)
+		}
+	})
+	depth := w.depth(op.SelectionSet)
+	if w.budget < 0 {
+		return nil
+	}
+
+	return map[string]string{
+		"operation_name": op.Name,
+		"operation_type": string(op.Operation),
+		"depth":          strconv.Itoa(depth),
+		"root_fields":    strings.Join(rootFields, ","),
+	}
+}
+
+// graphqlWalker walks selection sets with fragment spreads expanded.
+//
+// The results of each fragment are memoized, thus every fragment is walked
+// at most once no matter how many times it is spread, which prevents
+// documents with nested fragments from being expanded exponentially.
+type graphqlWalker struct {
+	fragments ast.FragmentDefinitionList
+	// The fragments being expanded, to avoid infinite recursion on
+	// (invalid) cyclic fragments.
+	visiting map[string]bool
+
+	// The memoized depth and field names of each fragment.
+	depths     map[string]int
+	fieldNames map[string][]string
+
+	// The number of selections that can still be walked. The walk stops
+	// once it goes negative.
+	budget int
+}
+
+// walk reports whether one more selection can be walked within the budget.
+func (w *graphqlWalker) walk() bool {
+	w.budget--
+	return w.budget >= 0
+}
+
+// fields calls f with the name of each field in set.
+func (w *graphqlWalker) fields(set ast.SelectionSet, f func(name string)) {
+	for _, sel := range set {
+		if !w.walk() {
+			return
+		}
+		switch sel := sel.(type) {
+		case *ast.Field:
+			f(sel.Name)
+		case *ast.InlineFragment:
+			w.fields(sel.SelectionSet, f)
+		case *ast.FragmentSpread:
+			for _, name := range w.fragmentFields(sel.Name) {
+				f(name)
+			}
+		}
+	}
+}
+
+// depth returns the maximum depth of set, where a selection set of leaf
+// fields has a depth of 1.
+func (w *graphqlWalker) depth(set ast.SelectionSet) int {
+	max := 0
+	for _, sel := range set {
+		if !w.walk() {
+			return max
+		}
+		d := 0
+		switch sel := sel.(type) {
+		case *ast.Field:
+			d = 1 + w.depth(sel.SelectionSet)
+		case *ast.InlineFragment:
+			d = w.depth(sel.SelectionSet)
+		case *ast.FragmentSpread:
+			d = w.fragmentDepth(sel.Name)
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// fragmentFields returns the distinct names of the fields in the named
+// fragment, if any.
+func (w *graphqlWalker) fragmentFields(name string) []string {
+	if names, ok := w.fieldNames[name]; ok || w.visiting[name] {
+		return names
+	}
+	var names []string
+	seen := make(map[string]bool)
+	w.expand(name, func(set ast.SelectionSet) {
+		w.fields(set, func(name string) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		})
+	})
+	w.fieldNames[name] = names
+	return names
+}
+
+// fragmentDepth returns the depth of the named fragment, if any.
+func (w *graphqlWalker) fragmentDepth(name string) int {
+	if d, ok := w.depths[name]; ok || w.visiting[name] {
+		return d
+	}
+	d := 0
+	w.expand(name, func(set ast.SelectionSet) { d = w.depth(set) })
+	w.depths[name] = d
+	return d
+}
+
+// expand calls f with the selection set of the named fragment, if any.
+func (w *graphqlWalker) expand(name string, f func(set ast.SelectionSet)) {
+	def := w.fragments.ForName(name)
+	if def == nil || w.visiting[name] {
+		return
+	}
+	w.visiting[name] = true
+	f(def.SelectionSet)
+	delete(w.visiting, name)
+}
@@ -0,0 +1,168 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGraphQL_Query(t *testing.T) {
+	query := `
+query GetUser($id: ID!) {
+  user(id: $id) {
+    name
+    friends { ...friendFields }
+  }
+  viewer { id }
+  user(id: 2) { name }
+}
+
+mutation DeleteUser { deleteUser(id: 1) }
+
+fragment friendFields on User {
+  name
+  posts { title }
+}
+`
+
+	// Each fragment spreads the previous one twice, which would be expanded
+	// into 2^40 selections without memoization.
+	var sb strings.Builder
+	sb.WriteString("{ ...f40 } fragment f0 on Query { a b }")
+	for i := 1; i <= 40; i++ {
+		fmt.Fprintf(&sb, " fragment f%d on Query { x { ...f%d } ...f%d }", i, i-1, i-1)
+	}
+	exponentialQuery := sb.String()
+
+	cases := []struct {
+		name    string
+		inQuery string
+		inOp    string
+		want    map[string]string
+	}{
+		{
+			name:    "query",
+			inQuery: query,
+			inOp:    "GetUser",
+			want: map[string]string{
+				"graphql.operation_name": "GetUser",
+				"graphql.operation_type": "query",
+				"graphql.depth":          "4",
+				"graphql.root_fields":    "user,viewer",
+				"graphql.unknown":        "",
+				"user":                   "",
+			},
+		},
+		{
+			name:    "mutation",
+			inQuery: query,
+			inOp:    "DeleteUser",
+			want: map[string]string{
+				"graphql.operation_name": "DeleteUser",
+				"graphql.operation_type": "mutation",
+				"graphql.depth":          "1",
+				"graphql.root_fields":    "deleteUser",
+			},
+		},
+		{
+			name:    "anonymous",
+			inQuery: `{ a { b } ... on Query { c } }`,
+			want: map[string]string{
+				"graphql.operation_name": "",
+				"graphql.operation_type": "query",
+				"graphql.depth":          "2",
+				"graphql.root_fields":    "a,c",
+			},
+		},
+		{
+			name:    "no operation selected",
+			inQuery: query,
+			want: map[string]string{
+				"graphql.operation_type": "",
+				"graphql.depth":          "",
+			},
+		},
+		{
+			name:    "cyclic fragments",
+			inQuery: `{ a { ...f } } fragment f on A { b { ...f } }`,
+			want: map[string]string{
+				"graphql.depth": "2",
+			},
+		},
+		{
+			name:    "exponential fragments",
+			inQuery: exponentialQuery,
+			want: map[string]string{
+				"graphql.depth":       "41",
+				"graphql.root_fields": "x,a,b",
+			},
+		},
+		{
+			name:    "too many selections",
+			inQuery: "{ " + strings.Repeat("a ", maxGraphQLSelections+1) + "}",
+			want: map[string]string{
+				"graphql.operation_type": "",
+				"graphql.depth":          "",
+			},
+		},
+		{
+			name:    "invalid",
+			inQuery: `{ a `,
+			want: map[string]string{
+				"graphql.operation_type": "",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g := &GraphQL{query: c.inQuery, operationName: c.inOp}
+			for key, want := range c.want {
+				if result := g.Query(key); result != want {
+					t.Fatalf("Result(%q): got (%#v), want (%#v)", key, result, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJSON_Query_GraphQL(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		key  string
+		want string
+	}{
+		{
+			name: "envelope",
+			in:   `{"query":"query Q { a b }","operationName":"Q","variables":{"id":1}}`,
+			key:  "graphql.root_fields",
+			want: "a,b",
+		},
+		{
+			name: "ordinary field in envelope",
+			in:   `{"query":"query Q { a b }","operationName":"Q","variables":{"id":1}}`,
+			key:  "variables.id",
+			want: "1",
+		},
+		{
+			name: "not an envelope",
+			in:   `{"graphql":{"depth":"x"}}`,
+			key:  "graphql.depth",
+			want: "x",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q, err := newQuerier(bytes.NewBufferString(c.in), "application/json", "/", nil)
+			if err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+			if result := q.Query(c.key); result != c.want {
+				t.Fatalf("Result: got (%#v), want (%#v)", result, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package requestbodyvar
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+const bodyHashReplPrefix = "http.request.body_hash."
+
+// hashes are the supported hash algorithms.
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func init() {
+	caddy.RegisterModule(RequestBodyHMAC{})
+	httpcaddyfile.RegisterHandlerDirective("request_body_hmac", parseHMACCaddyfile)
+}
+
+// RequestBodyHMAC implements an HTTP handler that verifies the HMAC signature
+// of the raw request body (e.g. of GitHub or Stripe webhooks), and rejects
+// the request with 401 (Unauthorized) if the signature mismatches.
+//
+// The handler must be placed before RequestBodyRewrite, since the signature
+// is of the original body. Otherwise, the request will be rejected with 500
+// (Internal Server Error).
+//
+// The digests of the raw request body are available in the placeholders
+// `{http.request.body_hash.<algorithm>}`, where algorithm is one of `md5`,
+// `sha1`, `sha256` and `sha512`. They are the same as the placeholders
+// `{http.request.body.hash.<algorithm>}` of RequestBodyVar.
+type RequestBodyHMAC struct {
+	// The secret key, which supports global placeholders (e.g.
+	// `{env.WEBHOOK_SECRET}`).
+	Secret string `json:"secret,omitempty"`
+
+	// The hash algorithm, which is one of `sha1` and `sha256`. Defaults to
+	// `sha256`.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// The header containing the signature (e.g. `X-Hub-Signature-256`).
+	Header string `json:"header,omitempty"`
+
+	// The prefix of the signature in the header (e.g. `sha256=`). If the
+	// header contains multiple comma-separated elements (e.g. `t=...,v1=...`),
+	// all elements with the prefix are tried.
+	Prefix string `json:"prefix,omitempty"`
+
+	// The encoding of the signature, which is one of `hex` and `base64`.
+	// Defaults to `hex`.
+	Encoding string `json:"encoding,omitempty"`
+
+	// The header containing the timestamp (in Unix seconds) of the request,
+	// if any. The timestamp is signed along with the body.
+	TimestampHeader string `json:"timestamp_header,omitempty"`
+
+	// The key of the timestamp, if the timestamp is an element (e.g. `t=...`)
+	// of the comma-separated elements in TimestampHeader.
+	TimestampKey string `json:"timestamp_key,omitempty"`
+
+	// The prefix of the body in the signed payload, where `{timestamp}` is
+	// replaced with the timestamp (e.g. `v0:{timestamp}:`). Defaults to
+	// `{timestamp}.` if TimestampHeader is specified.
+	PayloadPrefix string `json:"payload_prefix,omitempty"`
+
+	// The maximum difference between the timestamp and the current time.
+	// Defaults to 5 minutes.
+	Tolerance caddy.Duration `json:"tolerance,omitempty"`
+
+	// The maximum size (in bytes) of the request body to buffer. If the body
+	// is larger, the request will be rejected with 413 (Request Entity Too
+	// Large). Defaults to 0 (i.e. no limit).
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	secret []byte
+	now    func() time.Time
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (RequestBodyHMAC) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.request_body_hmac",
+		New: func() caddy.Module { return new(RequestBodyHMAC) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (h *RequestBodyHMAC) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger(h)
+	h.provision()
+	return nil
+}
+
+func (h *RequestBodyHMAC) provision() {
+	if h.Algorithm == "" {
+		h.Algorithm = "sha256"
+	}
+	if h.Encoding == "" {
+		h.Encoding = "hex"
+	}
+	if h.TimestampHeader != "" && h.PayloadPrefix == "" {
+		h.PayloadPrefix = "{timestamp}."
+	}
+	if h.Tolerance == 0 {
+		h.Tolerance = caddy.Duration(5 * time.Minute)
+	}
+	h.secret = []byte(caddy.NewReplacer().ReplaceKnown(h.Secret, ""))
+	h.now = time.Now
+}
+
+// Validate implements caddy.Validator.
+func (h *RequestBodyHMAC) Validate() error {
+	if len(h.secret) == 0 {
+		return fmt.Errorf("empty secret")
+	}
+	if h.Algorithm != "sha1" && h.Algorithm != "sha256" {
+		return fmt.Errorf("unknown algorithm: %q", h.Algorithm)
+	}
+	if h.Header == "" {
+		return fmt.Errorf("no header")
+	}
+	if h.Encoding != "hex" && h.Encoding != "base64" {
+		return fmt.Errorf("unknown encoding: %q", h.Encoding)
+	}
+	if h.TimestampKey != "" && h.TimestampHeader == "" {
+		return fmt.Errorf("timestamp_key requires timestamp_header")
+	}
+	if h.Tolerance < 0 {
+		return fmt.Errorf("tolerance must not be negative: %v", h.Tolerance)
+	}
+	if h.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative: %d", h.MaxSize)
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (h RequestBodyHMAC) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// The buffered body is shared with the other handlers (e.g.
+	// RequestBodyVar) and matchers.
+	buf, oversize, err := bufferBody(r, h.MaxSize)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if oversize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body too large: > %d", h.MaxSize))
+	}
+	// A valid signature would mismatch the rewritten body.
+	c := loadBodyCache(r)
+	if c.rewritten {
+		h.logger.Error("request body has been rewritten, place request_body_hmac before request_body_rewrite")
+		return caddyhttp.Error(http.StatusInternalServerError,
+			fmt.Errorf("request body has been rewritten before verifying"))
+	}
+
+	if err := h.verify(r, buf.Bytes()); err != nil {
+		h.logger.Debug("failed to verify signature", zap.Error(err))
+		return caddyhttp.Error(http.StatusUnauthorized, err)
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Map(func(key string) (interface{}, bool) {
+		if !strings.HasPrefix(key, bodyHashReplPrefix) {
+			return nil, false
+		}
+		// The digests are computed once and cached, see bodyCache.digest.
+		digest, ok := c.digest(key[len(bodyHashReplPrefix):])
+		if !ok {
+			return nil, false
+		}
+		return digest, true
+	})
+
+	return next.ServeHTTP(w, r)
+}
+
+// verify verifies the signature of the request, whose body is body.
+func (h RequestBodyHMAC) verify(r *http.Request, body []byte) error {
+	mac := hmac.New(hashes[h.Algorithm], h.secret)
+
+	if h.TimestampHeader != "" {
+		timestamp := r.Header.Get(h.TimestampHeader)
+		if h.TimestampKey != "" {
+			timestamp = headerElement(timestamp, h.TimestampKey+"=")
+		}
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp: %q", timestamp)
+		}
+		if d := h.now().Sub(time.Unix(sec, 0)); d > time.Duration(h.Tolerance) || d < -time.Duration(h.Tolerance) {
+			return fmt.Errorf("timestamp out of tolerance: %s", timestamp)
+		}
+		mac.Write([]byte(strings.Replace(h.PayloadPrefix, "{timestamp}", timestamp, -1)))
+	} else if h.PayloadPrefix != "" {
+		mac.Write([]byte(h.PayloadPrefix))
+	}
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	value := r.Header.Get(h.Header)
+	for _, elem := range strings.Split(value, ",") {
+		elem = strings.TrimSpace(elem)
+		if !strings.HasPrefix(elem, h.Prefix) {
+			continue
+		}
+		sig, err := h.decode(elem[len(h.Prefix):])
+		if err != nil {
+			continue
+		}
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	if value == "" {
+		return fmt.Errorf("missing signature")
+	}
+	return fmt.Errorf("signature mismatch")
+}
+
+func (h RequestBodyHMAC) decode(s string) ([]byte, error) {
+	if h.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return hex.DecodeString(s)
+}
+
+// headerElement returns the value of the first element with the given
+// prefix in the comma-separated elements.
+func headerElement(value, prefix string) string {
+	for _, elem := range strings.Split(value, ",") {
+		elem = strings.TrimSpace(elem)
+		if strings.HasPrefix(elem, prefix) {
+			return elem[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//     request_body_hmac <secret> {
+//         algorithm sha1|sha256
+//         header    <name>
+//         prefix    <prefix>
+//         encoding  hex|base64
+//
+//         timestamp_header <name> [<key>]
+//         payload_prefix   <prefix>
+//         tolerance        <duration>
+//
+//         max_size <size>
+//     }
+//
+func (h *RequestBodyHMAC) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		h.Secret = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "algorithm":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Algorithm = d.Val()
+
+			case "header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Header = d.Val()
+
+			case "prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Prefix = d.Val()
+
+			case "encoding":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.Encoding = d.Val()
+
+			case "timestamp_header":
+				args := d.RemainingArgs()
+				switch len(args) {
+				case 2:
+					h.TimestampKey = args[1]
+					fallthrough
+				case 1:
+					h.TimestampHeader = args[0]
+				default:
+					return d.ArgErr()
+				}
+
+			case "payload_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.PayloadPrefix = d.Val()
+
+			case "tolerance":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("bad tolerance value %s: %v", d.Val(), err)
+				}
+				h.Tolerance = caddy.Duration(dur)
+
+			case "max_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_size value %s: %v", d.Val(), err)
+				}
+				h.MaxSize = int64(size)
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseHMACCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	hm := new(RequestBodyHMAC)
+	err := hm.UnmarshalCaddyfile(h.Dispenser)
+	if err != nil {
+		return nil, err
+	}
+
+	return hm, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*RequestBodyHMAC)(nil)
+	_ caddy.Validator             = (*RequestBodyHMAC)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RequestBodyHMAC)(nil)
+	_ caddyfile.Unmarshaler       = (*RequestBodyHMAC)(nil)
+)
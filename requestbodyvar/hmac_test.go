@@ -0,0 +1,249 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestRequestBodyHMAC_ServeHTTP(t *testing.T) {
+	const body = `{"action":"opened"}`
+	now := time.Unix(1600000000, 0)
+
+	sign := func(payload string) []byte {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(payload))
+		return mac.Sum(nil)
+	}
+	sha1Mac := hmac.New(sha1.New, []byte("secret"))
+	sha1Mac.Write([]byte(body))
+
+	os.Setenv("REQUESTBODYVAR_TEST_SECRET", "secret")
+	defer os.Unsetenv("REQUESTBODYVAR_TEST_SECRET")
+
+	cases := []struct {
+		name          string
+		inHMAC        *RequestBodyHMAC
+		inHeader      http.Header
+		wantErrStatus int
+	}{
+		{
+			name:   "github sha256",
+			inHMAC: &RequestBodyHMAC{Header: "X-Hub-Signature-256", Prefix: "sha256="},
+			inHeader: http.Header{
+				"X-Hub-Signature-256": {"sha256=" + hex.EncodeToString(sign(body))},
+			},
+		},
+		{
+			name:   "github sha1",
+			inHMAC: &RequestBodyHMAC{Algorithm: "sha1", Header: "X-Hub-Signature", Prefix: "sha1="},
+			inHeader: http.Header{
+				"X-Hub-Signature": {"sha1=" + hex.EncodeToString(sha1Mac.Sum(nil))},
+			},
+		},
+		{
+			name:   "secret from env",
+			inHMAC: &RequestBodyHMAC{Secret: "{env.REQUESTBODYVAR_TEST_SECRET}", Header: "X-Signature"},
+			inHeader: http.Header{
+				"X-Signature": {hex.EncodeToString(sign(body))},
+			},
+		},
+		{
+			name:   "base64",
+			inHMAC: &RequestBodyHMAC{Header: "X-Signature", Encoding: "base64"},
+			inHeader: http.Header{
+				"X-Signature": {base64.StdEncoding.EncodeToString(sign(body))},
+			},
+		},
+		{
+			name:          "mismatch",
+			inHMAC:        &RequestBodyHMAC{Header: "X-Hub-Signature-256", Prefix: "sha256="},
+			inHeader:      http.Header{"X-Hub-Signature-256": {"sha256=" + hex.EncodeToString(sign("other"))}},
+			wantErrStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "missing signature",
+			inHMAC:        &RequestBodyHMAC{Header: "X-Hub-Signature-256"},
+			wantErrStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "malformed signature",
+			inHMAC:        &RequestBodyHMAC{Header: "X-Signature"},
+			inHeader:      http.Header{"X-Signature": {"not hex"}},
+			wantErrStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "stripe",
+			inHMAC: &RequestBodyHMAC{
+				Header:          "Stripe-Signature",
+				Prefix:          "v1=",
+				TimestampHeader: "Stripe-Signature",
+				TimestampKey:    "t",
+			},
+			inHeader: http.Header{
+				"Stripe-Signature": {"t=1600000010,v1=" + hex.EncodeToString(sign("other")) +
+					",v1=" + hex.EncodeToString(sign("1600000010."+body))},
+			},
+		},
+		{
+			name: "slack",
+			inHMAC: &RequestBodyHMAC{
+				Header:          "X-Slack-Signature",
+				Prefix:          "v0=",
+				TimestampHeader: "X-Slack-Request-Timestamp",
+				PayloadPrefix:   "v0:{timestamp}:",
+			},
+			inHeader: http.Header{
+				"X-Slack-Signature":         {"v0=" + hex.EncodeToString(sign("v0:1599999990:"+body))},
+				"X-Slack-Request-Timestamp": {"1599999990"},
+			},
+		},
+		{
+			name: "timestamp out of tolerance",
+			inHMAC: &RequestBodyHMAC{
+				Header:          "X-Signature",
+				TimestampHeader: "X-Timestamp",
+				Tolerance:       caddy.Duration(time.Minute),
+			},
+			inHeader: http.Header{
+				"X-Signature": {hex.EncodeToString(sign("1599999900." + body))},
+				"X-Timestamp": {"1599999900"},
+			},
+			wantErrStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid timestamp",
+			inHMAC: &RequestBodyHMAC{
+				Header:          "X-Signature",
+				TimestampHeader: "X-Timestamp",
+			},
+			inHeader: http.Header{
+				"X-Signature": {hex.EncodeToString(sign("." + body))},
+			},
+			wantErrStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "over max size",
+			inHMAC:        &RequestBodyHMAC{Header: "X-Signature", MaxSize: 5},
+			inHeader:      http.Header{"X-Signature": {hex.EncodeToString(sign(body))}},
+			wantErrStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := c.inHMAC
+			if h.Secret == "" {
+				h.Secret = "secret"
+			}
+			h.logger = zap.NewNop()
+			h.provision()
+			h.now = func() time.Time { return now }
+			if err := h.Validate(); err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			for k, v := range c.inHeader {
+				req.Header[k] = v
+			}
+			repl := caddyhttp.NewTestReplacer(req)
+			req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+
+			var gotBody string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				b, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				gotBody = string(b)
+				return nil
+			})
+
+			err := h.ServeHTTP(httptest.NewRecorder(), req, next)
+			if c.wantErrStatus != 0 {
+				if handlerErr, ok := err.(caddyhttp.HandlerError); !ok || handlerErr.StatusCode != c.wantErrStatus {
+					t.Fatalf("Err: got (%#v), want status (%#v)", err, c.wantErrStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			// The body must be left intact.
+			if gotBody != body {
+				t.Fatalf("Body: got (%#v), want (%#v)", gotBody, body)
+			}
+		})
+	}
+}
+
+func TestRequestBodyHMAC_HashPlaceholders(t *testing.T) {
+	const body = "hello"
+	h := &RequestBodyHMAC{Secret: "secret", Header: "X-Signature", logger: zap.NewNop()}
+	h.provision()
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	repl := caddyhttp.NewTestReplacer(req)
+	req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	if err := h.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	cases := map[string]string{
+		"{http.request.body_hash.md5}":    "5d41402abc4b2a76b9719d911017c592",
+		"{http.request.body_hash.sha1}":   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		"{http.request.body_hash.sha256}": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"{http.request.body_hash.sha3}":   "",
+	}
+	for in, want := range cases {
+		if got := repl.ReplaceAll(in, ""); got != want {
+			t.Fatalf("%s: got (%#v), want (%#v)", in, got, want)
+		}
+	}
+}
+
+func TestRequestBodyHMAC_ServeHTTP_rewritten(t *testing.T) {
+	const body = `{"action":"opened"}`
+	h := &RequestBodyHMAC{Secret: "secret", Header: "X-Signature", logger: zap.NewNop()}
+	h.provision()
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	repl := caddyhttp.NewTestReplacer(req)
+	req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+
+	// Rewritten by request_body_rewrite, which is placed before.
+	loadBodyCache(req).reset(bytes.NewBufferString(body))
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error { return nil })
+	err := h.ServeHTTP(httptest.NewRecorder(), req, next)
+	if handlerErr, ok := err.(caddyhttp.HandlerError); !ok || handlerErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Err: got (%#v), want status (%#v)", err, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,263 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/PaesslerAG/gval"
+	"github.com/PaesslerAG/jsonpath"
+	"github.com/jmespath/go-jmespath"
+	"github.com/tidwall/gjson"
+)
+
+// Query languages for the JSON documents (including those converted from
+// other formats).
+const (
+	langGJSON    = "gjson"
+	langJSONPath = "jsonpath"
+	langJMESPath = "jmespath"
+)
+
+// jsonPathLanguage is JSONPath with the full gval expressions (e.g. `>` and
+// `&&`) in filters and scripts.
+var jsonPathLanguage = gval.Full(jsonpath.Language())
+
+// isQueryLanguage reports whether lang is one of the supported query languages.
+func isQueryLanguage(lang string) bool {
+	switch lang {
+	case langGJSON, langJSONPath, langJMESPath:
+		return true
+	default:
+		return false
+	}
+}
+
+// newJSONQuerier creates a querier for the JSON document buffered in buf,
+// which uses the given query language. Empty lang means gjson.
+func newJSONQuerier(buf *bytes.Buffer, lang string) TypedQuerier {
+	switch lang {
+	case langJSONPath:
+		return &JSONPath{buf: buf}
+	case langJMESPath:
+		return &JMESPath{buf: buf}
+	default:
+		return GJSON{buf: buf}
+	}
+}
+
+// GJSON queries the value of a field in a JSON document by using the gjson
+// path syntax (e.g. `name.last` or `friends.#`).
+type GJSON struct {
+	buf *bytes.Buffer
+}
+
+func (g GJSON) Query(key string) string {
+	return getJSONField(g.buf, key)
+}
+
+func (g GJSON) QueryRaw(key string) string {
+	if g.buf == nil {
+		return ""
+	}
+	value := gjson.GetBytes(g.buf.Bytes(), key)
+	switch {
+	case value.Type == gjson.Null:
+		return ""
+	case value.Raw == "":
+		// The value is calculated (e.g. by `friends.#`).
+		return formatRawJSON(value.Value())
+	default:
+		return value.Raw
+	}
+}
+
+// JSONPath queries the value of a field in a JSON document by using JSONPath
+// (e.g. `$.name.last` or `$.friends[0].first`). The leading `$.` can be
+// omitted. The document is decoded once at the first query.
+type JSONPath struct {
+	buf *bytes.Buffer
+
+	once sync.Once
+	doc  interface{}
+	ok   bool
+}
+
+func (p *JSONPath) Query(key string) string {
+	return formatJSONValue(p.query(key))
+}
+
+func (p *JSONPath) QueryRaw(key string) string {
+	return formatRawJSON(p.query(key))
+}
+
+func (p *JSONPath) query(key string) interface{} {
+	p.once.Do(func() {
+		p.doc, p.ok = decodeJSON(p.buf)
+	})
+	if !p.ok {
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(key, "$"):
+	case strings.HasPrefix(key, "["):
+		key = "$" + key
+	default:
+		key = "$." + key
+	}
+	value, err := jsonPathLanguage.Evaluate(key, p.doc)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// JMESPath queries the value of a field in a JSON document by using JMESPath
+// (e.g. `name.last` or `friends[?age > `30`].first`). The document is decoded
+// once at the first query.
+type JMESPath struct {
+	buf *bytes.Buffer
+
+	once sync.Once
+	doc  interface{}
+	ok   bool
+}
+
+func (p *JMESPath) Query(key string) string {
+	return formatJSONValue(p.query(key))
+}
+
+func (p *JMESPath) QueryRaw(key string) string {
+	return formatRawJSON(p.query(key))
+}
+
+func (p *JMESPath) query(key string) interface{} {
+	p.once.Do(func() {
+		p.doc, p.ok = decodeJSON(p.buf)
+	})
+	if !p.ok {
+		return nil
+	}
+
+	value, err := jmespath.Search(key, p.doc)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// decodeJSON decodes the JSON document buffered in buf. Numbers are decoded
+// by using numberValue, to keep the precision of big integers.
+func decodeJSON(buf *bytes.Buffer) (interface{}, bool) {
+	if buf == nil {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	// Reject trailing data, in the same way as json.Unmarshal.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	return convertNumbers(v), true
+}
+
+// convertNumbers replaces the numbers (as json.Number) in v with the values
+// returned by numberValue.
+func convertNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		return numberValue(v)
+	case []interface{}:
+		for i, e := range v {
+			v[i] = convertNumbers(e)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = convertNumbers(e)
+		}
+	}
+	return v
+}
+
+// numberValue converts n into float64, which is required by the comparisons
+// and the functions of JMESPath, unless n is an integer that float64 can not
+// represent exactly. Such a big integer is kept as json.Number, which is
+// formatted as is but can not be compared in JMESPath.
+func numberValue(n json.Number) interface{} {
+	const maxExactInt = 1 << 53
+	if !strings.ContainsAny(n.String(), ".eE") {
+		i, err := n.Int64()
+		if err != nil || i > maxExactInt || i < -maxExactInt {
+			return n
+		}
+		return float64(i)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return n
+	}
+	return f
+}
+
+// formatJSONValue formats a queried value, regardless of the query language:
+//
+// - null (or nothing) is formatted as an empty string.
+// - a string is formatted as is (i.e. unquoted).
+// - any other value (including an array or an object) is formatted as compact
+//   JSON, with the keys of objects sorted.
+func formatJSONValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// formatRawJSON encodes a queried value into compact JSON. Null (or nothing)
+// is encoded as an empty string.
+func formatRawJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// getJSONField gets the value of the given field from the JSON body,
+// which is buffered in buf.
+func getJSONField(buf *bytes.Buffer, key string) string {
+	if buf == nil {
+		return ""
+	}
+	value := gjson.GetBytes(buf.Bytes(), key)
+	if !value.IsArray() && !value.IsObject() {
+		return value.String()
+	}
+
+	// Re-encode arrays and objects, so that they are formatted in the same
+	// way as in the other query languages. Numbers are decoded as is to keep
+	// their precision.
+	dec := json.NewDecoder(strings.NewReader(value.Raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return value.String()
+	}
+	return formatJSONValue(v)
+}
@@ -0,0 +1,336 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONQuerier_Query(t *testing.T) {
+	body := `{
+  "name": {"last": "Prichard", "first": "Janet"},
+  "age": 47,
+  "admin": false,
+  "nickname": null,
+  "friends": [
+    {"first": "Dale", "age": 44},
+    {"first": "Roger", "age": 68}
+  ]
+}`
+
+	cases := []struct {
+		name   string
+		inLang string
+		want   map[string]string
+	}{
+		{
+			name:   "gjson",
+			inLang: langGJSON,
+			want: map[string]string{
+				"name.last":       "Prichard",
+				"age":             "47",
+				"admin":           "false",
+				"nickname":        "",
+				"friends.1.first": "Roger",
+				"friends.#.first": `["Dale","Roger"]`,
+				"name":            `{"first":"Janet","last":"Prichard"}`,
+				"unknown":         "",
+			},
+		},
+		{
+			name:   "jsonpath",
+			inLang: langJSONPath,
+			want: map[string]string{
+				"$.name.last":                    "Prichard",
+				"name.last":                      "Prichard",
+				"age":                            "47",
+				"admin":                          "false",
+				"nickname":                       "",
+				"$.friends[1].first":             "Roger",
+				"friends[*].first":               `["Dale","Roger"]`,
+				"$.friends[?(@.age > 50)].first": `["Roger"]`,
+				"name":                           `{"first":"Janet","last":"Prichard"}`,
+				"unknown":                        "",
+				"$[":                             "",
+			},
+		},
+		{
+			name:   "jmespath",
+			inLang: langJMESPath,
+			want: map[string]string{
+				"name.last":                        "Prichard",
+				"age":                              "47",
+				"admin":                            "false",
+				"nickname":                         "",
+				"friends[1].first":                 "Roger",
+				"friends[*].first":                 `["Dale","Roger"]`,
+				"friends[?age > `50`].first | [0]": "Roger",
+				"length(friends)":                  "2",
+				"name":                             `{"first":"Janet","last":"Prichard"}`,
+				"unknown":                          "",
+				"friends[":                         "",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q := newJSONQuerier(bytes.NewBufferString(body), c.inLang)
+			for key, want := range c.want {
+				if result := q.Query(key); result != want {
+					t.Fatalf("Result(%q): got (%#v), want (%#v)", key, result, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewQuerier_QueryLanguage(t *testing.T) {
+	cases := []struct {
+		name          string
+		inBody        string
+		inContentType string
+		inLang        string
+		inKey         string
+		want          string
+	}{
+		{
+			name:          "json with jmespath",
+			inBody:        `{"friends":[{"first":"Dale"},{"first":"Roger"}]}`,
+			inContentType: "application/json",
+			inLang:        langJMESPath,
+			inKey:         "friends[-1].first",
+			want:          "Roger",
+		},
+		{
+			name:          "graphql keys with jmespath",
+			inBody:        `{"query":"query Q { a b }"}`,
+			inContentType: "application/json",
+			inLang:        langJMESPath,
+			inKey:         "graphql.root_fields",
+			want:          "a,b",
+		},
+		{
+			name:          "yaml with jsonpath",
+			inBody:        "friends:\n  - first: Dale\n  - first: Roger\n",
+			inContentType: "application/yaml",
+			inLang:        langJSONPath,
+			inKey:         "$.friends[-1:].first",
+			want:          `["Roger"]`,
+		},
+		{
+			name:          "invalid xml with jsonpath",
+			inBody:        `<name>`,
+			inContentType: "application/xml",
+			inLang:        langJSONPath,
+			inKey:         "name",
+			want:          "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q, err := newQuerier(bytes.NewBufferString(c.inBody), c.inContentType, "/", &querierOptions{queryLanguage: c.inLang})
+			if err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+			if result := q.Query(c.inKey); result != c.want {
+				t.Fatalf("Result: got (%#v), want (%#v)", result, c.want)
+			}
+		})
+	}
+}
+
+func TestQueryValue(t *testing.T) {
+	const body = `{"name":"caddy","age":5,"ratio":0.5,"big":12345678901234567890,"ok":true,"nil":null,"tags":["a","b"],"owner":{"id":1}}`
+
+	cases := []struct {
+		name          string
+		inBody        string
+		inContentType string
+		inLang        string
+		inKey         string
+		wantValue     interface{}
+		wantRaw       string
+	}{
+		{
+			name:      "string",
+			inBody:    body,
+			inKey:     "name",
+			wantValue: "caddy",
+			wantRaw:   `"caddy"`,
+		},
+		{
+			name:      "integer",
+			inBody:    body,
+			inKey:     "age",
+			wantValue: json.Number("5"),
+			wantRaw:   "5",
+		},
+		{
+			name:      "big integer",
+			inBody:    body,
+			inKey:     "big",
+			wantValue: json.Number("12345678901234567890"),
+			wantRaw:   "12345678901234567890",
+		},
+		{
+			name:      "boolean",
+			inBody:    body,
+			inKey:     "ok",
+			wantValue: true,
+			wantRaw:   "true",
+		},
+		{
+			name:      "null",
+			inBody:    body,
+			inKey:     "nil",
+			wantValue: nil,
+			wantRaw:   "",
+		},
+		{
+			name:      "nothing",
+			inBody:    body,
+			inKey:     "unknown",
+			wantValue: nil,
+			wantRaw:   "",
+		},
+		{
+			name:      "array",
+			inBody:    body,
+			inKey:     "tags",
+			wantValue: []interface{}{"a", "b"},
+			wantRaw:   `["a","b"]`,
+		},
+		{
+			name:      "object",
+			inBody:    body,
+			inKey:     "owner",
+			wantValue: map[string]interface{}{"id": json.Number("1")},
+			wantRaw:   `{"id":1}`,
+		},
+		{
+			name:      "calculated",
+			inBody:    body,
+			inKey:     "tags.#",
+			wantValue: json.Number("2"),
+			wantRaw:   "2",
+		},
+		{
+			name:      "jsonpath",
+			inBody:    body,
+			inLang:    langJSONPath,
+			inKey:     "$.ratio",
+			wantValue: json.Number("0.5"),
+			wantRaw:   "0.5",
+		},
+		{
+			name:      "big integer with jsonpath",
+			inBody:    `{"user":{"id":1234567890123456789}}`,
+			inLang:    langJSONPath,
+			inKey:     "user.id",
+			wantValue: json.Number("1234567890123456789"),
+			wantRaw:   "1234567890123456789",
+		},
+		{
+			name:      "big integer with jmespath",
+			inBody:    `{"user":{"id":1234567890123456789}}`,
+			inLang:    langJMESPath,
+			inKey:     "user",
+			wantValue: map[string]interface{}{"id": json.Number("1234567890123456789")},
+			wantRaw:   `{"id":1234567890123456789}`,
+		},
+		{
+			name:      "jmespath",
+			inBody:    body,
+			inLang:    langJMESPath,
+			inKey:     "owner",
+			wantValue: map[string]interface{}{"id": json.Number("1")},
+			wantRaw:   `{"id":1}`,
+		},
+		{
+			name:          "yaml",
+			inBody:        "age: 5\n",
+			inContentType: "application/yaml",
+			inKey:         "age",
+			wantValue:     json.Number("5"),
+			wantRaw:       "5",
+		},
+		{
+			name:          "xml",
+			inBody:        `<age>5</age>`,
+			inContentType: "application/xml",
+			inKey:         "age",
+			// All values converted from XML are strings.
+			wantValue: "5",
+			wantRaw:   `"5"`,
+		},
+		{
+			name:      "graphql",
+			inBody:    `{"query":"query Q { a }"}`,
+			inKey:     "graphql.operation_name",
+			wantValue: "Q",
+			wantRaw:   `"Q"`,
+		},
+		{
+			name:          "form",
+			inBody:        "age=5",
+			inContentType: "application/x-www-form-urlencoded",
+			inKey:         "age",
+			wantValue:     "5",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q, err := newQuerier(bytes.NewBufferString(c.inBody), c.inContentType, "/", &querierOptions{queryLanguage: c.inLang})
+			if err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+			if value := QueryValue(q, c.inKey); !reflect.DeepEqual(value, c.wantValue) {
+				t.Fatalf("Value: got (%#v), want (%#v)", value, c.wantValue)
+			}
+			tq, ok := q.(TypedQuerier)
+			if !ok {
+				return
+			}
+			if raw := tq.QueryRaw(c.inKey); raw != c.wantRaw {
+				t.Fatalf("Raw: got (%#v), want (%#v)", raw, c.wantRaw)
+			}
+		})
+	}
+}
+
+func TestPlaceholderValue(t *testing.T) {
+	q := &JSON{buf: bytes.NewBufferString(`{"name":"caddy","age":5,"ratio":1.50,"big":12345678901234567890,"ok":true,"tags":["a"]}`)}
+
+	cases := []struct {
+		inKey string
+		want  interface{}
+	}{
+		{"name", "caddy"},
+		{"age", int64(5)},
+		{"ratio", 1.5},
+		{"big", "12345678901234567890"},
+		{"ok", true},
+		{"tags", `["a"]`},
+		{"unknown", ""},
+	}
+	for _, c := range cases {
+		if value := placeholderValue(q, c.inKey); value != c.want {
+			t.Fatalf("Value(%q): got (%#v), want (%#v)", c.inKey, value, c.want)
+		}
+	}
+
+	// Big integers keep their precision regardless of the query language.
+	for _, lang := range []string{langGJSON, langJSONPath, langJMESPath} {
+		q := newJSONQuerier(bytes.NewBufferString(`{"user":{"id":1234567890123456789}}`), lang)
+		if value := placeholderValue(q, "user.id"); value != int64(1234567890123456789) {
+			t.Fatalf("Value(%q) with %s: got (%#v), want (%#v)", "user.id", lang, value, int64(1234567890123456789))
+		}
+		if result := q.Query("user.id"); result != "1234567890123456789" {
+			t.Fatalf("Result(%q) with %s: got (%#v), want (%#v)", "user.id", lang, result, "1234567890123456789")
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package requestbodyvar
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(MatchBody{})
+}
+
+// Operators of body conditions.
+const (
+	opEqual        = "eq"
+	opNotEqual     = "ne"
+	opRegexp       = "regexp"
+	opLess         = "lt"
+	opLessEqual    = "le"
+	opGreater      = "gt"
+	opGreaterEqual = "ge"
+	opExists       = "exists"
+	opNotExists    = "not_exists"
+)
+
+// BodyCondition is a condition on the value of a field in the request body.
+type BodyCondition struct {
+	// The key of the field, which is the same as the one used in the
+	// `{http.request.body.*}` placeholders (e.g. `name.first`).
+	Path string `json:"path,omitempty"`
+
+	// The operator, which is one of:
+	//
+	// - `eq`/`ne`: the value is equal/not equal to Value.
+	// - `regexp`: the value matches the regular expression Value.
+	// - `lt`/`le`/`gt`/`ge`: the value is a number, which is less than/
+	//   less than or equal to/greater than/greater than or equal to Value.
+	// - `exists`/`not_exists`: the field exists (with a non-empty value)
+	//   or not.
+	Op string `json:"op,omitempty"`
+
+	// The operand of Op. Unused for `exists` and `not_exists`.
+	Value string `json:"value,omitempty"`
+
+	re     *regexp.Regexp
+	number float64
+}
+
+func (c *BodyCondition) provision() (err error) {
+	switch c.Op {
+	case opEqual, opNotEqual:
+	case opRegexp:
+		c.re, err = regexp.Compile(c.Value)
+		if err != nil {
+			return fmt.Errorf("bad regexp for path %s: %v", c.Path, err)
+		}
+	case opLess, opLessEqual, opGreater, opGreaterEqual:
+		c.number, err = strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			return fmt.Errorf("bad number for path %s: %v", c.Path, err)
+		}
+	case opExists, opNotExists:
+		if c.Value != "" {
+			return fmt.Errorf("unexpected value for op %s: %q", c.Op, c.Value)
+		}
+	default:
+		return fmt.Errorf("unknown op for path %s: %q", c.Path, c.Op)
+	}
+	if c.Path == "" {
+		return fmt.Errorf("empty path")
+	}
+	return nil
+}
+
+// match reports whether the queried value satisfies the condition.
+func (c *BodyCondition) match(value string) bool {
+	switch c.Op {
+	case opEqual:
+		return value == c.Value
+	case opNotEqual:
+		return value != c.Value
+	case opRegexp:
+		return c.re.MatchString(value)
+	case opExists:
+		return value != ""
+	case opNotExists:
+		return value == ""
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	switch c.Op {
+	case opLess:
+		return n < c.number
+	case opLessEqual:
+		return n <= c.number
+	case opGreater:
+		return n > c.number
+	case opGreaterEqual:
+		return n >= c.number
+	default:
+		return false
+	}
+}
+
+// MatchBody implements a request matcher, which matches requests by the
+// fields of their bodies. The body is parsed in the same way as the
+// `{http.request.body.*}` placeholders, and is left intact for the next
+// handlers. The buffered body and the parsed one are shared with the other
+// matchers and handlers (e.g. RequestBodyVar) of the request.
+//
+// The matcher can't be used in CEL expressions, since Caddy v2.4 has no way
+// for matchers to extend them. Use the `{http.request.body.*}` placeholders
+// of RequestBodyVar in expressions instead.
+type MatchBody struct {
+	// The conditions, all of which must be satisfied.
+	Conditions []*BodyCondition `json:"conditions,omitempty"`
+
+	// The maximum size (in bytes) of the request body to buffer. If the body
+	// is larger, the request will not match. Defaults to 0 (i.e. no limit).
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// The maximum size (in bytes) of the decoded request body, if the body
+	// is compressed. Defaults to 10MiB. See RequestBodyVar.MaxDecodedSize.
+	MaxDecodedSize int64 `json:"max_decoded_size,omitempty"`
+
+	// The format of all request bodies, regardless of the `Content-Type`
+	// header. See RequestBodyVar.Format.
+	Format string `json:"format,omitempty"`
+
+	// The extra mappings from media types to formats.
+	// See RequestBodyVar.MediaTypes.
+	MediaTypes map[string]string `json:"media_types,omitempty"`
+
+	// The format of request bodies with unsupported (or invalid) media
+	// types. See RequestBodyVar.Fallback.
+	Fallback string `json:"fallback,omitempty"`
+
+	// The query language of the paths. Defaults to `gjson`.
+	// See RequestBodyVar.QueryLanguage.
+	QueryLanguage string `json:"query_language,omitempty"`
+
+	querierOpts *querierOptions
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (MatchBody) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.body",
+		New: func() caddy.Module { return new(MatchBody) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (m *MatchBody) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+	return m.provision()
+}
+
+func (m *MatchBody) provision() error {
+	if m.MaxDecodedSize == 0 {
+		m.MaxDecodedSize = 10 << 20 // At most 10MiB by default
+	}
+	m.querierOpts = &querierOptions{
+		format:     m.Format,
+		mediaTypes: m.MediaTypes,
+		fallback:   m.Fallback,
+
+		queryLanguage: m.QueryLanguage,
+	}
+	for _, c := range m.Conditions {
+		if err := c.provision(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (m *MatchBody) Validate() error {
+	if len(m.Conditions) == 0 {
+		return fmt.Errorf("no conditions")
+	}
+	if m.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative: %d", m.MaxSize)
+	}
+	if m.MaxDecodedSize < 0 {
+		return fmt.Errorf("max_decoded_size must not be negative: %d", m.MaxDecodedSize)
+	}
+	// There is no descriptor set for protobuf bodies.
+	if err := validateFormats(m.Format, m.MediaTypes, m.Fallback, false); err != nil {
+		return err
+	}
+	if m.QueryLanguage != "" && !isQueryLanguage(m.QueryLanguage) {
+		return fmt.Errorf("unknown query_language: %q", m.QueryLanguage)
+	}
+	return nil
+}
+
+// Match implements caddyhttp.RequestMatcher.
+func (m *MatchBody) Match(r *http.Request) bool {
+	querier, err := m.querier(r)
+	if err != nil {
+		m.logger.Debug("failed to query body", zap.Error(err))
+		return false
+	}
+	for _, c := range m.Conditions {
+		if !c.match(querier.Query(c.Path)) {
+			return false
+		}
+	}
+	return true
+}
+
+// querier returns the querier for the body of r. The body, if read, is always
+// restored for the next handlers (and matchers). The buffered body and the
+// querier are shared with the other matchers and handlers (e.g.
+// RequestBodyVar) of the request, thus the body is parsed at most once for
+// the same options.
+func (m *MatchBody) querier(r *http.Request) (Querier, error) {
+	return loadBodyCache(r).querier(newQuerierKey(m.MaxSize, m.MaxDecodedSize, m.querierOpts), func() (Querier, error) {
+		buf, oversize, err := bufferBody(r, m.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		if oversize {
+			return nil, fmt.Errorf("request body too large: > %d", m.MaxSize)
+		}
+
+		body, err := decodeBody(buf, r.Header.Get("Content-Encoding"), m.MaxDecodedSize)
+		if err != nil {
+			return nil, err
+		}
+		return newQuerier(body, r.Header.Get("Content-Type"), r.URL.Path, m.querierOpts)
+	})
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//     body <path> <op> [<value>] {
+//         max_size         <size>
+//         max_decoded_size <size>
+//         format           <format>
+//         media_type       <media_type> <format>
+//         fallback         <format>
+//         query_language   gjson|jsonpath|jmespath
+//     }
+//
+// Multiple `body` matchers with the same name are merged, i.e. all the
+// conditions must be satisfied.
+func (m *MatchBody) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		args := d.RemainingArgs()
+		c := &BodyCondition{}
+		switch len(args) {
+		case 3:
+			c.Value = args[2]
+			fallthrough
+		case 2:
+			c.Path, c.Op = args[0], args[1]
+		default:
+			return d.ArgErr()
+		}
+		m.Conditions = append(m.Conditions, c)
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "max_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_size value %s: %v", d.Val(), err)
+				}
+				m.MaxSize = int64(size)
+
+			case "max_decoded_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_decoded_size value %s: %v", d.Val(), err)
+				}
+				m.MaxDecodedSize = int64(size)
+
+			case "format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Format = d.Val()
+
+			case "media_type":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if m.MediaTypes == nil {
+					m.MediaTypes = make(map[string]string)
+				}
+				m.MediaTypes[args[0]] = args[1]
+
+			case "fallback":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Fallback = d.Val()
+
+			case "query_language":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.QueryLanguage = d.Val()
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner        = (*MatchBody)(nil)
+	_ caddy.Validator          = (*MatchBody)(nil)
+	_ caddyhttp.RequestMatcher = (*MatchBody)(nil)
+	_ caddyfile.Unmarshaler    = (*MatchBody)(nil)
+)
@@ -0,0 +1,379 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestMatchBody_Match(t *testing.T) {
+	body := `{"action":"delete","amount":150,"user":{"name":"caddy","admin":false}}`
+
+	cases := []struct {
+		name          string
+		inMatcher     *MatchBody
+		inContentType string
+		inBody        string
+		inBuffered    bool
+		wantMatched bool
+		wantErrStr  string
+	}{
+		{
+			name: "eq",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "action", Op: "eq", Value: "delete"},
+			}},
+			inBody:      body,
+			wantMatched: true,
+		},
+		{
+			name: "ne",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "action", Op: "ne", Value: "delete"},
+			}},
+			inBody:      body,
+			wantMatched: false,
+		},
+		{
+			name: "regexp",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "user.name", Op: "regexp", Value: "^cad"},
+			}},
+			inBody:      body,
+			wantMatched: true,
+		},
+		{
+			name: "numeric comparisons",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "amount", Op: "gt", Value: "100"},
+				{Path: "amount", Op: "ge", Value: "150"},
+				{Path: "amount", Op: "le", Value: "150"},
+				{Path: "amount", Op: "lt", Value: "1e3"},
+			}},
+			inBody:      body,
+			wantMatched: true,
+		},
+		{
+			name: "numeric comparison with non-number",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "action", Op: "lt", Value: "100"},
+			}},
+			inBody:      body,
+			wantMatched: false,
+		},
+		{
+			name: "exists",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "user.admin", Op: "exists"},
+				{Path: "user.id", Op: "not_exists"},
+			}},
+			inBody:      body,
+			wantMatched: true,
+		},
+		{
+			name: "jmespath",
+			inMatcher: &MatchBody{
+				Conditions: []*BodyCondition{
+					{Path: "length(user.name)", Op: "eq", Value: "5"},
+				},
+				QueryLanguage: langJMESPath,
+			},
+			inBody:      body,
+			wantMatched: true,
+		},
+		{
+			name: "format",
+			inMatcher: &MatchBody{
+				Conditions: []*BodyCondition{
+					{Path: "action", Op: "eq", Value: "delete"},
+				},
+				Format: formatForm,
+			},
+			inBody:      "action=delete",
+			wantMatched: true,
+		},
+		{
+			name: "media type",
+			inMatcher: &MatchBody{
+				Conditions: []*BodyCondition{
+					{Path: "action", Op: "eq", Value: "delete"},
+				},
+				MediaTypes: map[string]string{"application/vnd.api+json": formatJSON},
+			},
+			inContentType: "application/vnd.api+json",
+			inBody:        body,
+			wantMatched:   true,
+		},
+		{
+			name: "fallback",
+			inMatcher: &MatchBody{
+				Conditions: []*BodyCondition{
+					{Path: "action", Op: "eq", Value: "delete"},
+				},
+				Fallback: formatJSON,
+			},
+			inContentType: "text/plain",
+			inBody:        body,
+			wantMatched:   true,
+		},
+		{
+			name: "unsupported media type",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "action", Op: "eq", Value: "delete"},
+			}},
+			inContentType: "text/plain",
+			inBody:        body,
+			wantMatched:   false,
+		},
+		{
+			name: "buffered body",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "action", Op: "eq", Value: "delete"},
+			}},
+			inBody:      body,
+			inBuffered:  true,
+			wantMatched: true,
+		},
+		{
+			name: "over max size",
+			inMatcher: &MatchBody{
+				Conditions: []*BodyCondition{
+					{Path: "action", Op: "eq", Value: "delete"},
+				},
+				MaxSize: 10,
+			},
+			inBody:      body,
+			wantMatched: false,
+		},
+		{
+			name: "bad regexp",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "action", Op: "regexp", Value: "("},
+			}},
+			wantErrStr: "bad regexp for path action: error parsing regexp: missing closing ): `(`",
+		},
+		{
+			name: "bad number",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "amount", Op: "gt", Value: "x"},
+			}},
+			wantErrStr: `bad number for path amount: strconv.ParseFloat: parsing "x": invalid syntax`,
+		},
+		{
+			name: "unknown op",
+			inMatcher: &MatchBody{Conditions: []*BodyCondition{
+				{Path: "amount", Op: "in", Value: "x"},
+			}},
+			wantErrStr: `unknown op for path amount: "in"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := c.inMatcher
+			m.logger = zap.NewNop()
+			if err := m.provision(); err != nil {
+				if err.Error() != c.wantErrStr {
+					t.Fatalf("ErrStr: got (%#v), want (%#v)", err.Error(), c.wantErrStr)
+				}
+				return
+			}
+			if c.wantErrStr != "" {
+				t.Fatalf("ErrStr: got (nil), want (%#v)", c.wantErrStr)
+			}
+
+			contentType := c.inContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.inBody))
+			r.Header.Set("Content-Type", contentType)
+			r = withVars(r)
+			if c.inBuffered {
+				loadBodyCache(r).buf = bytes.NewBufferString(c.inBody)
+			}
+
+			if matched := m.Match(r); matched != c.wantMatched {
+				t.Fatalf("Matched: got (%#v), want (%#v)", matched, c.wantMatched)
+			}
+
+			// The body must be left intact.
+			got, _ := ioutil.ReadAll(r.Body)
+			if string(got) != c.inBody {
+				t.Fatalf("Body: got (%#v), want (%#v)", string(got), c.inBody)
+			}
+		})
+	}
+}
+
+func TestMatchBody_Match_sharedWithRequestBodyVar(t *testing.T) {
+	m := &MatchBody{
+		Conditions: []*BodyCondition{{Path: "action", Op: "eq", Value: "delete"}},
+		logger:     zap.NewNop(),
+	}
+	if err := m.provision(); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	rbv := RequestBodyVar{OnOversize: "empty", MaxDecodedSize: m.MaxDecodedSize, logger: zap.NewNop()}
+	rbv.querierOpts = &querierOptions{}
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"action":"delete"}`))
+	repl := caddyhttp.NewTestReplacer(r)
+	r = withVars(r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl)))
+
+	// Evaluate the matcher repeatedly, as in multiple routes.
+	for i := 0; i < 2; i++ {
+		if !m.Match(r) {
+			t.Fatalf("Matched: got (%#v), want (%#v)", false, true)
+		}
+	}
+	querier, _ := m.querier(r)
+
+	var gotValue string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		gotValue = repl.ReplaceAll("{http.request.body.action}", "")
+		return nil
+	})
+	if err := rbv.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	if gotValue != "delete" {
+		t.Fatalf("Value: got (%#v), want (%#v)", gotValue, "delete")
+	}
+
+	// The body is parsed only once.
+	c := loadBodyCache(r)
+	if len(c.queriers) != 1 {
+		t.Fatalf("Queriers: got (%#v), want (%#v)", len(c.queriers), 1)
+	}
+	if q, _ := m.querier(r); q != querier {
+		t.Fatalf("Querier: got (%p), want (%p)", q, querier)
+	}
+}
+
+func TestMatchBody_UnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+body action eq delete
+body user.admin exists {
+	max_size 1KB
+	format yaml
+	media_type text/plain json
+	fallback form
+	query_language jmespath
+}`)
+
+	m := new(MatchBody)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	want := []BodyCondition{
+		{Path: "action", Op: "eq", Value: "delete"},
+		{Path: "user.admin", Op: "exists"},
+	}
+	if len(m.Conditions) != len(want) {
+		t.Fatalf("Conditions: got (%d), want (%d)", len(m.Conditions), len(want))
+	}
+	for i, c := range m.Conditions {
+		if *c != want[i] {
+			t.Fatalf("Condition[%d]: got (%#v), want (%#v)", i, *c, want[i])
+		}
+	}
+	if m.MaxSize != 1000 || m.QueryLanguage != langJMESPath {
+		t.Fatalf("Options: got (%d, %q), want (%d, %q)", m.MaxSize, m.QueryLanguage, 1000, langJMESPath)
+	}
+	if m.Format != formatYAML || m.MediaTypes["text/plain"] != formatJSON || m.Fallback != formatForm {
+		t.Fatalf("Formats: got (%q, %#v, %q), want (%q, %#v, %q)",
+			m.Format, m.MediaTypes, m.Fallback, formatYAML, map[string]string{"text/plain": formatJSON}, formatForm)
+	}
+}
+
+func TestMatchExpression_Body(t *testing.T) {
+	m := &caddyhttp.MatchExpression{
+		// Without TypedValues, all values are strings.
+		Expr: `{http.request.body.action} == "delete" && int({http.request.body.amount}) > 100 && {http.request.body.amount} != "50"`,
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	cases := []struct {
+		in          string
+		wantMatched bool
+	}{
+		{`{"action":"delete","amount":150}`, true},
+		{`{"action":"delete","amount":50}`, false},
+		{`{"action":"create","amount":150}`, false},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.in))
+		repl := caddyhttp.NewTestReplacer(req)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+		// The body placeholders are available to the expression matchers
+		// evaluated after request_body_var.
+		var matched bool
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			matched = m.Match(r)
+			return nil
+		})
+
+		rbv := RequestBodyVar{logger: zap.NewNop()}
+		if err := rbv.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+		if matched != c.wantMatched {
+			t.Fatalf("Matched(%s): got (%#v), want (%#v)", c.in, matched, c.wantMatched)
+		}
+	}
+}
+
+func TestMatchExpression_TypedBody(t *testing.T) {
+	// Booleans and numbers are typed with TypedValues, so no conversion
+	// is needed.
+	m := &caddyhttp.MatchExpression{
+		Expr: `{http.request.body.admin} && {http.request.body.amount} > 100`,
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	cases := []struct {
+		in          string
+		wantMatched bool
+	}{
+		{`{"admin":true,"amount":150}`, true},
+		{`{"admin":true,"amount":50}`, false},
+		{`{"admin":false,"amount":150}`, false},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.in))
+		repl := caddyhttp.NewTestReplacer(req)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+		var matched bool
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			matched = m.Match(r)
+			return nil
+		})
+
+		rbv := RequestBodyVar{TypedValues: true, logger: zap.NewNop()}
+		if err := rbv.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+			t.Fatalf("Err: %v", err)
+		}
+		if matched != c.wantMatched {
+			t.Fatalf("Matched(%s): got (%#v), want (%#v)", c.in, matched, c.wantMatched)
+		}
+	}
+}
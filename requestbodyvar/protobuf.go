@@ -0,0 +1,164 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// decodeProtobuf returns a decoder which decodes a protobuf message of the
+// given type into JSON (with the original field names).
+//
+// If framed is true, the message is expected to be in a gRPC frame (i.e.
+// a 1-byte compressed flag followed by a 4-byte length).
+func decodeProtobuf(desc protoreflect.MessageDescriptor, framed bool) func([]byte) (interface{}, error) {
+	return func(data []byte) (interface{}, error) {
+		if framed {
+			var err error
+			if data, err = unframeGRPC(data); err != nil {
+				return nil, err
+			}
+		}
+
+		msg := dynamicpb.NewMessage(desc)
+		if err := proto.Unmarshal(data, msg); err != nil {
+			return nil, err
+		}
+		json, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		return jsonRaw(json), nil
+	}
+}
+
+// unframeGRPC returns the message in the first gRPC frame of data.
+func unframeGRPC(data []byte) ([]byte, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("malformed grpc frame")
+	}
+	if data[0] != 0 {
+		return nil, fmt.Errorf("compressed grpc message is unsupported")
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint64(len(data)-5) < uint64(n) {
+		return nil, fmt.Errorf("malformed grpc frame")
+	}
+	return data[5 : 5+n], nil
+}
+
+// protoTypes resolves the message types of protobuf bodies from a set of
+// file descriptors.
+type protoTypes struct {
+	files *protoregistry.Files
+	// The full name of the message type for all protobuf bodies. If empty,
+	// the message type is resolved per request.
+	messageType string
+}
+
+// loadProtoTypes loads the file descriptor set (which is generated by
+// `protoc --include_imports --descriptor_set_out`) from the given file.
+func loadProtoTypes(filename, messageType string) (*protoTypes, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	set := new(descriptorpb.FileDescriptorSet)
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("parsing descriptor set %s: %v", filename, err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("parsing descriptor set %s: %v", filename, err)
+	}
+
+	t := &protoTypes{files: files, messageType: messageType}
+	if messageType != "" {
+		if _, err := t.message(messageType); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// resolve resolves the message type of a protobuf body. The message type
+// is determined, in order of precedence, by:
+//
+// - the configured message type.
+// - the `messageType` (or `proto`) parameter of the Content-Type header.
+// - the input type of the gRPC method specified by path (i.e. `/<service>/<method>`).
+func (t *protoTypes) resolve(params map[string]string, path string) (protoreflect.MessageDescriptor, error) {
+	if t.messageType != "" {
+		return t.message(t.messageType)
+	}
+	for _, name := range []string{"messagetype", "proto"} {
+		if typ := params[name]; typ != "" {
+			return t.message(typ)
+		}
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("unknown message type for path: %q", path)
+	}
+	d, err := t.files.FindDescriptorByName(protoreflect.FullName(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("unknown service %q: %v", parts[0], err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("not a service: %q", parts[0])
+	}
+	md := sd.Methods().ByName(protoreflect.Name(parts[1]))
+	if md == nil {
+		return nil, fmt.Errorf("unknown method %q of service %q", parts[1], parts[0])
+	}
+	return md.Input(), nil
+}
+
+func (t *protoTypes) message(name string) (protoreflect.MessageDescriptor, error) {
+	d, err := t.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("unknown message type %q: %v", name, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("not a message type: %q", name)
+	}
+	return md, nil
+}
+
+// newProtobuf creates a querier for a protobuf body of the given format,
+// which is one of `protobuf`, `grpc` and `grpc-web-text`.
+func newProtobuf(buf *bytes.Buffer, format string, params map[string]string, path string, opts *querierOptions) (Querier, error) {
+	types := opts.protoTypes
+	if types == nil {
+		return nil, fmt.Errorf("no descriptor set for format: %q", format)
+	}
+	desc, err := types.resolve(params, path)
+	if err != nil {
+		return nil, err
+	}
+
+	framed := format != formatProtobuf
+	if format == formatGRPCWebText {
+		// The body of gRPC-Web-Text is base64-encoded.
+		data, err := base64.StdEncoding.DecodeString(buf.String())
+		if err != nil {
+			return nil, err
+		}
+		buf = bytes.NewBuffer(data)
+	}
+	return &Document{buf: buf, decode: decodeProtobuf(desc, framed), lang: opts.queryLanguage}, nil
+}
@@ -0,0 +1,184 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// writeDescriptorSet writes the descriptor set of the following proto file
+// into a temporary file, and returns the file path.
+//
+//     syntax = "proto3";
+//     package test;
+//     message Name { string first = 1; string last = 2; }
+//     message User { Name name = 1; int32 age = 2; }
+//     service Users { rpc Create(User) returns (User); }
+//
+func writeDescriptorSet(t *testing.T, dir string) string {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+
+	set := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("test.proto"),
+			Package: proto.String("test"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{
+				{
+					Name: proto.String("Name"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("first", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+						field("last", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+					},
+				},
+				{
+					Name: proto.String("User"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Name"),
+						field("age", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+					},
+				},
+			},
+			Service: []*descriptorpb.ServiceDescriptorProto{{
+				Name: proto.String("Users"),
+				Method: []*descriptorpb.MethodDescriptorProto{{
+					Name:       proto.String("Create"),
+					InputType:  proto.String(".test.User"),
+					OutputType: proto.String(".test.User"),
+				}},
+			}},
+		}},
+	}
+
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	filename := filepath.Join(dir, "test.protoset")
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	return filename
+}
+
+func TestProtobuf_Query(t *testing.T) {
+	dir, err := ioutil.TempDir("", "requestbodyvar")
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	types, err := loadProtoTypes(writeDescriptorSet(t, dir), "")
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	// Encode a test.User message.
+	desc, _ := types.message("test.User")
+	user := dynamicpb.NewMessage(desc)
+	name := dynamicpb.NewMessage(desc.Fields().ByName("name").Message())
+	name.Set(name.Descriptor().Fields().ByName("last"), protoreflect.ValueOfString("Prichard"))
+	user.Set(desc.Fields().ByName("name"), protoreflect.ValueOfMessage(name))
+	user.Set(desc.Fields().ByName("age"), protoreflect.ValueOfInt32(47))
+	msg, err := proto.Marshal(user)
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	frame = append(frame, msg...)
+
+	cases := []struct {
+		name          string
+		inBody        []byte
+		inContentType string
+		inPath        string
+		inTypes       *protoTypes
+		wantErrStr    string
+	}{
+		{
+			name:          "protobuf with message type",
+			inBody:        msg,
+			inContentType: "application/x-protobuf",
+			inTypes:       &protoTypes{files: types.files, messageType: "test.User"},
+		},
+		{
+			name:          "protobuf with content type parameter",
+			inBody:        msg,
+			inContentType: `application/x-protobuf; messageType="test.User"`,
+			inTypes:       types,
+		},
+		{
+			name:          "grpc",
+			inBody:        frame,
+			inContentType: "application/grpc",
+			inPath:        "/test.Users/Create",
+			inTypes:       types,
+		},
+		{
+			name:          "grpc-web-text",
+			inBody:        []byte(base64.StdEncoding.EncodeToString(frame)),
+			inContentType: "application/grpc-web-text+proto",
+			inPath:        "/test.Users/Create",
+			inTypes:       types,
+		},
+		{
+			name:          "unknown method",
+			inBody:        frame,
+			inContentType: "application/grpc",
+			inPath:        "/test.Users/Delete",
+			inTypes:       types,
+			wantErrStr:    `unknown method "Delete" of service "test.Users"`,
+		},
+		{
+			name:          "no descriptor set",
+			inBody:        msg,
+			inContentType: "application/x-protobuf",
+			wantErrStr:    `no descriptor set for format: "protobuf"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q, err := newQuerier(bytes.NewBuffer(c.inBody), c.inContentType, c.inPath, &querierOptions{protoTypes: c.inTypes})
+			if err != nil {
+				if err.Error() != c.wantErrStr {
+					t.Fatalf("ErrStr: got (%#v), want (%#v)", err.Error(), c.wantErrStr)
+				}
+				return
+			}
+			if c.wantErrStr != "" {
+				t.Fatalf("ErrStr: got (nil), want (%#v)", c.wantErrStr)
+			}
+
+			if result := q.Query("name.last"); result != "Prichard" {
+				t.Fatalf("Result: got (%#v), want (%#v)", result, "Prichard")
+			}
+			if result := q.Query("age"); result != "47" {
+				t.Fatalf("Result: got (%#v), want (%#v)", result, "47")
+			}
+		})
+	}
+}
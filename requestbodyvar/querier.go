@@ -2,66 +2,514 @@ package requestbodyvar
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"mime"
+	"mime/multipart"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/BurntSushi/toml"
 	"github.com/basgys/goxml2json"
-	"github.com/tidwall/gjson"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v2"
 )
 
 type Querier interface {
 	Query(string) string
 }
 
+// emptyQuerier is the querier of a body which fails to be decoded or parsed,
+// and whose fields are all empty.
+type emptyQuerier struct{}
+
+func (emptyQuerier) Query(string) string { return "" }
+
+// TypedQuerier is implemented by the queriers of bodies in JSON, or in other
+// formats which are converted into JSON, whose values are typed.
+type TypedQuerier interface {
+	Querier
+
+	// QueryRaw returns the raw JSON of the value of the given field, or
+	// empty if the value is null or does not exist.
+	QueryRaw(string) string
+}
+
+// QueryValue queries the value of the given field as a native Go value,
+// which is one of:
+//
+// - nil, for null (or nothing).
+// - bool, json.Number or string, for scalars.
+// - []interface{} or map[string]interface{}, for arrays or objects.
+//
+// If q is not a TypedQuerier (e.g. for forms), the value is always the
+// string returned by q.Query.
+func QueryValue(q Querier, key string) interface{} {
+	tq, ok := q.(TypedQuerier)
+	if !ok {
+		return q.Query(key)
+	}
+	raw := tq.QueryRaw(key)
+	if raw == "" {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil
+	}
+	return v
+}
+
+// placeholderValue queries the value of the given field for a placeholder,
+// if typed values are enabled (see RequestBodyVar.TypedValues).
+// Booleans and numbers are typed (as bool, int64 or float64), which can be
+// used as is in CEL expressions and are stringified by Caddy in the same way
+// as Query does. Any other value is the string returned by q.Query.
+func placeholderValue(q Querier, key string) interface{} {
+	switch v := QueryValue(q, key).(type) {
+	case bool:
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		// Integers out of the range of int64 are kept as strings, to avoid
+		// losing precision.
+		if strings.ContainsAny(v.String(), ".eE") {
+			if f, err := v.Float64(); err == nil {
+				return f
+			}
+		}
+	}
+	return q.Query(key)
+}
+
+// jsonBodier is implemented by the queriers of bodies in JSON, or in other
+// formats which are converted into JSON.
+type jsonBodier interface {
+	// jsonBody returns the JSON body, or nil if the conversion fails.
+	jsonBody() *bytes.Buffer
+}
+
+// JSON queries the value of a field in a JSON document. If the document
+// is a GraphQL request, the information of the GraphQL operation can also
+// be queried by using the `graphql.*` keys (see GraphQL).
 type JSON struct {
-	buf *bytes.Buffer
+	buf  *bytes.Buffer
+	lang string
+
+	once    sync.Once
+	graphql *GraphQL
+	docOnce sync.Once
+	doc     TypedQuerier
 }
 
-func (j JSON) Query(key string) string {
-	return getJSONField(j.buf, key)
+func (j *JSON) Query(key string) string {
+	if g := j.graphQL(key); g != nil {
+		return g.Query(key)
+	}
+	return j.document().Query(key)
 }
 
-type XML struct {
-	buf *bytes.Buffer
+func (j *JSON) QueryRaw(key string) string {
+	if g := j.graphQL(key); g != nil {
+		// All values of the GraphQL operation are strings.
+		if value := g.Query(key); value != "" {
+			return formatRawJSON(value)
+		}
+		return ""
+	}
+	return j.document().QueryRaw(key)
+}
+
+// graphQL returns the GraphQL request, if key is one of the `graphql.*` keys
+// and the document is a GraphQL request. Otherwise, it returns nil.
+func (j *JSON) graphQL(key string) *GraphQL {
+	if !strings.HasPrefix(key, graphqlKeyPrefix) {
+		return nil
+	}
+	j.once.Do(func() {
+		j.graphql = newGraphQLFromJSON(j.buf)
+	})
+	return j.graphql
+}
+
+func (j *JSON) document() TypedQuerier {
+	j.docOnce.Do(func() {
+		j.doc = newJSONQuerier(j.buf, j.lang)
+	})
+	return j.doc
+}
+
+func (j *JSON) jsonBody() *bytes.Buffer {
+	return j.buf
 }
 
-func (x XML) Query(key string) string {
-	json, err := xml2json.Convert(x.buf)
+// Document queries the value of a field in a document of a format other
+// than JSON (e.g. XML, YAML, TOML, MessagePack or protobuf), which is decoded
+// by decode and converted into JSON once at the first query.
+type Document struct {
+	buf    *bytes.Buffer
+	decode func([]byte) (interface{}, error)
+	lang   string
+
+	once sync.Once
+	json *bytes.Buffer
+	doc  TypedQuerier
+}
+
+func (d *Document) Query(key string) string {
+	d.convert()
+	return d.doc.Query(key)
+}
+
+func (d *Document) QueryRaw(key string) string {
+	d.convert()
+	return d.doc.QueryRaw(key)
+}
+
+func (d *Document) jsonBody() *bytes.Buffer {
+	d.convert()
+	return d.json
+}
+
+func (d *Document) convert() {
+	d.once.Do(func() {
+		d.json = convertToJSON(d.buf, d.decode)
+		d.doc = newJSONQuerier(d.json, d.lang)
+	})
+}
+
+// decodeXML decodes an XML document into JSON.
+func decodeXML(data []byte) (interface{}, error) {
+	// Convert a copy of the buffered body, which must be left intact.
+	json, err := xml2json.Convert(bytes.NewReader(data))
 	if err != nil {
-		return ""
+		return nil, err
+	}
+	return jsonRaw(json.Bytes()), nil
+}
+
+// decodeWith returns a decoder which decodes a document by using unmarshal.
+func decodeWith(unmarshal func([]byte, interface{}) error) func([]byte) (interface{}, error) {
+	return func(data []byte) (interface{}, error) {
+		var v interface{}
+		if err := unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+// Form queries the value of a field in an URL-encoded form. If the field
+// has multiple values, the first one is returned.
+type Form struct {
+	buf *bytes.Buffer
+
+	once   sync.Once
+	values url.Values
+}
+
+func (f *Form) Query(key string) string {
+	f.once.Do(func() {
+		values, err := url.ParseQuery(f.buf.String())
+		if err == nil {
+			f.values = values
+		}
+	})
+	return f.values.Get(key)
+}
+
+// Multipart queries the value of a field in a multipart form. For a file
+// field, the metadata of the file can be queried by using one of the keys
+// `<field>.filename`, `<field>.size` and `<field>.content_type`.
+type Multipart struct {
+	buf      *bytes.Buffer
+	boundary string
+
+	once   sync.Once
+	fields map[string]string
+	files  map[string]map[string]string
+}
+
+func (m *Multipart) Query(key string) string {
+	m.once.Do(m.parse)
+
+	if value, ok := m.fields[key]; ok {
+		return value
 	}
-	return getJSONField(json, key)
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		return m.files[key[:i]][key[i+1:]]
+	}
+	return ""
+}
+
+// parse parses the form, and keeps the first value of each ordinary field
+// and the metadata of the first file of each file field.
+func (m *Multipart) parse() {
+	m.fields = make(map[string]string)
+	m.files = make(map[string]map[string]string)
+
+	r := multipart.NewReader(bytes.NewReader(m.buf.Bytes()), m.boundary)
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			return
+		}
+
+		name := part.FormName()
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(part)
+			if err != nil {
+				return
+			}
+			if _, ok := m.fields[name]; !ok {
+				m.fields[name] = string(value)
+			}
+			continue
+		}
+
+		size, err := io.Copy(ioutil.Discard, part)
+		if err != nil {
+			return
+		}
+		if _, ok := m.files[name]; !ok {
+			m.files[name] = map[string]string{
+				"filename":     part.FileName(),
+				"size":         strconv.FormatInt(size, 10),
+				"content_type": part.Header.Get("Content-Type"),
+			}
+		}
+	}
+}
+
+// Formats of request bodies.
+const (
+	formatJSON        = "json"
+	formatXML         = "xml"
+	formatYAML        = "yaml"
+	formatTOML        = "toml"
+	formatMessagePack = "msgpack"
+	formatProtobuf    = "protobuf"
+	formatGRPC        = "grpc"
+	formatGRPCWebText = "grpc-web-text"
+	formatGraphQL     = "graphql"
+	formatForm        = "form"
+	formatMultipart   = "multipart"
+)
+
+// isFormat reports whether format is one of the supported formats.
+func isFormat(format string) bool {
+	switch format {
+	case formatJSON, formatXML, formatYAML, formatTOML, formatMessagePack,
+		formatProtobuf, formatGRPC, formatGRPCWebText, formatGraphQL,
+		formatForm, formatMultipart:
+		return true
+	default:
+		return false
+	}
+}
+
+// validateFormats validates the format options, which are the same as
+// RequestBodyVar.Format, RequestBodyVar.MediaTypes and RequestBodyVar.Fallback.
+// Unless protobuf is true, the formats of protobuf bodies (which require
+// a descriptor set) are unsupported.
+func validateFormats(format string, mediaTypes map[string]string, fallback string, protobuf bool) error {
+	if format != "" && !isFormat(format) {
+		return fmt.Errorf("unknown format: %q", format)
+	}
+	for mediaType, format := range mediaTypes {
+		if !isFormat(format) {
+			return fmt.Errorf("unknown format for media type %s: %q", mediaType, format)
+		}
+	}
+	if fallback != "" && !isFormat(fallback) {
+		return fmt.Errorf("unknown fallback: %q", fallback)
+	}
+	if protobuf {
+		return nil
+	}
+
+	formats := []string{format, fallback}
+	for _, format := range mediaTypes {
+		formats = append(formats, format)
+	}
+	for _, format := range formats {
+		switch format {
+		case formatProtobuf, formatGRPC, formatGRPCWebText:
+			return fmt.Errorf("unsupported format: %q", format)
+		}
+	}
+	return nil
+}
+
+// querierOptions are the options for creating queriers.
+type querierOptions struct {
+	// The format of all bodies regardless of the Content-Type header.
+	format string
+	// The extra mappings from media types to formats, which take precedence
+	// over the built-in ones.
+	mediaTypes map[string]string
+	// The format of bodies with unsupported media types. Empty means that
+	// such bodies are unsupported.
+	fallback string
+	// The types for resolving the message types of protobuf bodies.
+	protoTypes *protoTypes
+	// The query language for the JSON documents (including those converted
+	// from other formats). Empty means gjson.
+	queryLanguage string
 }
 
-func newQuerier(buf *bytes.Buffer, contentType string) (Querier, error) {
+// newQuerier creates a querier for the body buffered in buf according to
+// contentType. For protobuf bodies, the message type is resolved along with
+// path for gRPC requests. If opts is nil, the default options will be used.
+func newQuerier(buf *bytes.Buffer, contentType, path string, opts *querierOptions) (Querier, error) {
+	if opts == nil {
+		opts = new(querierOptions)
+	}
+
 	mediaType := "application/json"
+	var params map[string]string
 	if contentType != "" {
 		var err error
-		mediaType, _, err = mime.ParseMediaType(contentType)
-		if err != nil {
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil && opts.format == "" && opts.fallback == "" {
 			return nil, err
 		}
 	}
 
+	format := opts.format
+	if format == "" {
+		format = opts.mediaTypes[mediaType]
+	}
+	if format == "" {
+		format = formatOf(mediaType)
+	}
+	if format == "" {
+		format = opts.fallback
+	}
+
+	switch format {
+	case formatJSON:
+		return &JSON{buf: buf, lang: opts.queryLanguage}, nil
+	case formatGraphQL:
+		return &GraphQL{query: buf.String()}, nil
+	case formatXML:
+		return &Document{buf: buf, decode: decodeXML, lang: opts.queryLanguage}, nil
+	case formatYAML:
+		return &Document{buf: buf, decode: decodeWith(yaml.Unmarshal), lang: opts.queryLanguage}, nil
+	case formatTOML:
+		return &Document{buf: buf, decode: decodeWith(toml.Unmarshal), lang: opts.queryLanguage}, nil
+	case formatMessagePack:
+		return &Document{buf: buf, decode: decodeWith(msgpack.Unmarshal), lang: opts.queryLanguage}, nil
+	case formatProtobuf, formatGRPC, formatGRPCWebText:
+		return newProtobuf(buf, format, params, path, opts)
+	case formatForm:
+		return &Form{buf: buf}, nil
+	case formatMultipart:
+		boundary := params["boundary"]
+		if boundary == "" {
+			return nil, fmt.Errorf("missing boundary for multipart/form-data")
+		}
+		return &Multipart{buf: buf, boundary: boundary}, nil
+	default:
+		return nil, fmt.Errorf("unsupported Media Type: %q", mediaType)
+	}
+}
+
+// formatOf returns the format of the given media type, or empty if
+// the media type is unsupported.
+func formatOf(mediaType string) string {
 	switch {
 	case mediaType == "application/json":
-		return JSON{buf: buf}, nil
+		return formatJSON
+	case mediaType == "application/graphql":
+		return formatGraphQL
 	case strings.HasSuffix(mediaType, "/xml"):
 		// application/xml
 		// text/xml
-		return XML{buf: buf}, nil
+		return formatXML
+	case mediaType == "application/yaml" || mediaType == "application/x-yaml" ||
+		mediaType == "text/yaml" || mediaType == "text/x-yaml":
+		return formatYAML
+	case mediaType == "application/toml":
+		return formatTOML
+	case mediaType == "application/msgpack" || mediaType == "application/x-msgpack" ||
+		mediaType == "application/vnd.msgpack":
+		return formatMessagePack
+	case mediaType == "application/x-protobuf" || mediaType == "application/protobuf":
+		return formatProtobuf
+	case strings.HasPrefix(mediaType, "application/grpc-web-text"):
+		// application/grpc-web-text(+proto)
+		return formatGRPCWebText
+	case mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+") ||
+		strings.HasPrefix(mediaType, "application/grpc-web"):
+		// application/grpc(+proto)
+		// application/grpc-web(+proto)
+		return formatGRPC
+	case mediaType == "application/x-www-form-urlencoded":
+		return formatForm
+	case mediaType == "multipart/form-data":
+		return formatMultipart
 	default:
-		return nil, fmt.Errorf("unsupported Media Type: %q", mediaType)
+		return ""
 	}
 }
 
-// getJSONField gets the value of the given field from the JSON body,
-// which is buffered in buf.
-func getJSONField(buf *bytes.Buffer, key string) string {
-	if buf == nil {
-		return ""
+// jsonRaw is a document which has already been converted into JSON by its
+// decoder (see Document), and is used as is.
+type jsonRaw []byte
+
+// convertToJSON decodes the document buffered in buf by using decode,
+// and encodes it into JSON. It returns nil if any error occurs.
+func convertToJSON(buf *bytes.Buffer, decode func([]byte) (interface{}, error)) *bytes.Buffer {
+	v, err := decode(buf.Bytes())
+	if err != nil {
+		return nil
+	}
+	if raw, ok := v.(jsonRaw); ok {
+		return bytes.NewBuffer(raw)
 	}
-	value := gjson.GetBytes(buf.Bytes(), key)
-	return value.String()
+	data, err := json.Marshal(normalize(v))
+	if err != nil {
+		return nil
+	}
+	return bytes.NewBuffer(data)
 }
+
+// normalize converts maps with non-string keys (e.g. those decoded from YAML)
+// into maps with string keys recursively, which can then be encoded into JSON.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = normalize(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalize(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalize(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// Interface guards
+var (
+	_ TypedQuerier = (*JSON)(nil)
+	_ TypedQuerier = (*Document)(nil)
+)
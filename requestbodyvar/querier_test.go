@@ -2,7 +2,12 @@ package requestbodyvar
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v2"
 )
 
 func TestJSON_Query(t *testing.T) {
@@ -15,7 +20,7 @@ func TestJSON_Query(t *testing.T) {
 }
 
 func TestXML_Query(t *testing.T) {
-	x := XML{buf: bytes.NewBufferString(`<?xml version="1.0" encoding="UTF-8"?>
+	x := Document{decode: decodeXML, buf: bytes.NewBufferString(`<?xml version="1.0" encoding="UTF-8"?>
   <name>
     <first>Janet</first>
     <last>Prichard</last>
@@ -27,3 +32,242 @@ func TestXML_Query(t *testing.T) {
 		t.Fatalf("Result: got (%#v), want (%#v)", result, want)
 	}
 }
+
+func TestYAML_Query(t *testing.T) {
+	y := Document{decode: decodeWith(yaml.Unmarshal), buf: bytes.NewBufferString(`
+name:
+  first: Janet
+  last: Prichard
+age: 47
+friends:
+  - first: Dale
+  - first: Roger
+`)}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"name.last", "Prichard"},
+		{"age", "47"},
+		{"friends.1.first", "Roger"},
+		{"friends.#", "2"},
+	}
+
+	for _, c := range cases {
+		result := y.Query(c.in)
+		if result != c.want {
+			t.Fatalf("Result(%q): got (%#v), want (%#v)", c.in, result, c.want)
+		}
+	}
+}
+
+func TestTOML_Query(t *testing.T) {
+	x := Document{decode: decodeWith(toml.Unmarshal), buf: bytes.NewBufferString(`
+age = 47
+
+[name]
+first = "Janet"
+last = "Prichard"
+`)}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"name.last", "Prichard"},
+		{"age", "47"},
+	}
+
+	for _, c := range cases {
+		result := x.Query(c.in)
+		if result != c.want {
+			t.Fatalf("Result(%q): got (%#v), want (%#v)", c.in, result, c.want)
+		}
+	}
+}
+
+func TestMessagePack_Query(t *testing.T) {
+	data, err := msgpack.Marshal(map[string]interface{}{
+		"name": map[string]interface{}{"first": "Janet", "last": "Prichard"},
+		"age":  47,
+	})
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	m := Document{decode: decodeWith(msgpack.Unmarshal), buf: bytes.NewBuffer(data)}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"name.last", "Prichard"},
+		{"age", "47"},
+	}
+
+	for _, c := range cases {
+		result := m.Query(c.in)
+		if result != c.want {
+			t.Fatalf("Result(%q): got (%#v), want (%#v)", c.in, result, c.want)
+		}
+	}
+}
+
+func TestForm_Query(t *testing.T) {
+	f := Form{buf: bytes.NewBufferString(`username=janet&password=p%40ss&role=admin&role=user`)}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"username", "janet"},
+		{"password", "p@ss"},
+		{"role", "admin"},
+		{"unknown", ""},
+	}
+
+	for _, c := range cases {
+		result := f.Query(c.in)
+		if result != c.want {
+			t.Fatalf("Result(%q): got (%#v), want (%#v)", c.in, result, c.want)
+		}
+	}
+}
+
+func TestMultipart_Query(t *testing.T) {
+	body := "--xxx\r\n" +
+		"Content-Disposition: form-data; name=\"username\"\r\n" +
+		"\r\n" +
+		"janet\r\n" +
+		"--xxx\r\n" +
+		"Content-Disposition: form-data; name=\"avatar\"; filename=\"me.png\"\r\n" +
+		"Content-Type: image/png\r\n" +
+		"\r\n" +
+		"0123456789\r\n" +
+		"--xxx--\r\n"
+
+	q, err := newQuerier(bytes.NewBufferString(body), "multipart/form-data; boundary=xxx", "/", nil)
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"username", "janet"},
+		{"avatar.filename", "me.png"},
+		{"avatar.size", "10"},
+		{"avatar.content_type", "image/png"},
+		{"avatar", ""},
+		{"username.filename", ""},
+		{"unknown", ""},
+	}
+
+	for _, c := range cases {
+		result := q.Query(c.in)
+		if result != c.want {
+			t.Fatalf("Result(%q): got (%#v), want (%#v)", c.in, result, c.want)
+		}
+	}
+}
+
+func BenchmarkXML_Query(b *testing.B) {
+	buf := bytes.NewBufferString(`<user><name><first>Janet</first><last>Prichard</last></name><age>47</age><email>janet@example.com</email><city>Paris</city></user>`)
+	keys := []string{"user.name.first", "user.name.last", "user.age", "user.email", "user.city"}
+
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				// A new querier for each key parses the body every time.
+				x := &Document{buf: buf, decode: decodeXML}
+				_ = x.Query(key)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			x := &Document{buf: buf, decode: decodeXML}
+			for _, key := range keys {
+				_ = x.Query(key)
+			}
+		}
+	})
+}
+
+func TestNewQuerier(t *testing.T) {
+	cases := []struct {
+		name          string
+		inContentType string
+		inOpts        *querierOptions
+		wantType      string
+		wantErrStr    string
+	}{
+		{
+			name:     "no content type",
+			wantType: "*requestbodyvar.JSON",
+		},
+		{
+			name:          "built-in media type",
+			inContentType: "text/xml; charset=utf-8",
+			wantType:      "*requestbodyvar.Document",
+		},
+		{
+			name:          "unsupported media type",
+			inContentType: "text/plain",
+			wantErrStr:    `unsupported Media Type: "text/plain"`,
+		},
+		{
+			name:          "fallback",
+			inContentType: "text/plain",
+			inOpts:        &querierOptions{fallback: formatJSON},
+			wantType:      "*requestbodyvar.JSON",
+		},
+		{
+			name:          "invalid media type with fallback",
+			inContentType: "/",
+			inOpts:        &querierOptions{fallback: formatJSON},
+			wantType:      "*requestbodyvar.JSON",
+		},
+		{
+			name:          "extra media type",
+			inContentType: "application/vnd.api+json",
+			inOpts:        &querierOptions{mediaTypes: map[string]string{"application/vnd.api+json": formatJSON}},
+			wantType:      "*requestbodyvar.JSON",
+		},
+		{
+			name:          "overridden media type",
+			inContentType: "text/xml",
+			inOpts:        &querierOptions{mediaTypes: map[string]string{"text/xml": formatYAML}},
+			wantType:      "*requestbodyvar.Document",
+		},
+		{
+			name:          "forced format",
+			inContentType: "application/json",
+			inOpts:        &querierOptions{format: formatForm, fallback: formatJSON},
+			wantType:      "*requestbodyvar.Form",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q, err := newQuerier(bytes.NewBufferString(""), c.inContentType, "/", c.inOpts)
+			if err != nil {
+				if err.Error() != c.wantErrStr {
+					t.Fatalf("ErrStr: got (%#v), want (%#v)", err.Error(), c.wantErrStr)
+				}
+				return
+			}
+			if c.wantErrStr != "" {
+				t.Fatalf("ErrStr: got (nil), want (%#v)", c.wantErrStr)
+			}
+
+			if gotType := fmt.Sprintf("%T", q); gotType != c.wantType {
+				t.Fatalf("Type: got (%#v), want (%#v)", gotType, c.wantType)
+			}
+		})
+	}
+}
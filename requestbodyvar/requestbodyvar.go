@@ -2,9 +2,9 @@ package requestbodyvar
 
 import (
 	"bytes"
-	"context"
+	"encoding/hex"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"strings"
 
@@ -12,6 +12,7 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
 )
 
@@ -19,8 +20,12 @@ const (
 	fullReqBodyReplPrefix  = "http.request.body."
 	shortReqBodyReplPrefix = "body."
 
-	// For the request's buffered body
-	bodyBufferCtxKey caddy.CtxKey = "body_buffer"
+	// The prefix of the keys of the body digests, e.g. `hash.sha256`.
+	hashKeyPrefix = "hash."
+
+	// For the bodyCache of the request in its variable table, which (unlike
+	// the request context) is shared by the handlers and the matchers.
+	bodyCacheVarKey = "request_body_var.body_cache"
 )
 
 func init() {
@@ -30,7 +35,81 @@ func init() {
 
 // RequestBodyVar implements an HTTP handler that replaces {http.request.body.*}
 // with the value of the given field from request body, if any.
+//
+// If TypedValues is enabled, booleans and numbers are typed (see QueryValue),
+// which can be used as is in CEL expressions.
+//
+// The hex-encoded digests of the raw request body are available in the
+// placeholders `{http.request.body.hash.<algorithm>}`, where algorithm is one
+// of `md5`, `sha1`, `sha256` and `sha512`. Once RequestBodyRewrite is in
+// effect, they are the digests of the rewritten body.
 type RequestBodyVar struct {
+	// The maximum size (in bytes) of the request body to buffer. If the body
+	// is larger, the placeholders will resolve to empty, and the body will be
+	// passed to the next handler intact. Defaults to 0 (i.e. no limit).
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// What to do when the request body is larger than MaxSize:
+	//
+	// - `empty`: resolve the placeholders to empty.
+	// - `error`: respond with 413 (Request Entity Too Large) if the
+	//   `Content-Length` header exceeds MaxSize. Bodies of unknown length
+	//   are handled as `empty`.
+	//
+	// Defaults to `empty`.
+	OnOversize string `json:"on_oversize,omitempty"`
+
+	// The maximum size (in bytes) of the decoded request body, if the body
+	// is compressed (i.e. `Content-Encoding` is one of `gzip`, `deflate`, `br`
+	// and `zstd`). If the decoded body is larger, the placeholders will
+	// resolve to empty. Defaults to 10MiB.
+	//
+	// Note that only the buffered copy of the body is decoded, while the
+	// body passed to the next handler is left unchanged.
+	MaxDecodedSize int64 `json:"max_decoded_size,omitempty"`
+
+	// The path to the file descriptor set (which is generated by
+	// `protoc --include_imports --descriptor_set_out`) used to decode
+	// protobuf and gRPC bodies.
+	DescriptorSet string `json:"descriptor_set,omitempty"`
+
+	// The full name of the message type (e.g. `mypkg.MyRequest`) for
+	// protobuf and gRPC bodies. If omitted, the message type is determined
+	// by the `messageType` parameter of the `Content-Type` header, or by
+	// the gRPC method in the request path.
+	MessageType string `json:"message_type,omitempty"`
+
+	// The format of all request bodies, regardless of the `Content-Type`
+	// header. Supported formats are `json`, `xml`, `yaml`, `toml`, `msgpack`,
+	// `protobuf`, `grpc`, `grpc-web-text`, `graphql`, `form` and `multipart`.
+	// Defaults to "" (i.e. determined by the `Content-Type` header).
+	Format string `json:"format,omitempty"`
+
+	// The extra mappings from media types to formats (e.g.
+	// `application/vnd.api+json` to `json`), which take precedence over
+	// the built-in ones.
+	MediaTypes map[string]string `json:"media_types,omitempty"`
+
+	// The format of request bodies with unsupported (or invalid) media
+	// types, e.g. `json` for legacy clients sending JSON as `text/plain`.
+	// Defaults to "" (i.e. the placeholders resolve to empty).
+	Fallback string `json:"fallback,omitempty"`
+
+	// The query language of the placeholder keys for JSON bodies (and those
+	// converted into JSON, i.e. XML, YAML, TOML, MessagePack and protobuf).
+	// Supported languages are `gjson`, `jsonpath` and `jmespath`. Arrays and
+	// objects are returned as compact JSON in all languages. Defaults to `gjson`.
+	QueryLanguage string `json:"query_language,omitempty"`
+
+	// Whether to provide booleans and numbers as typed values (i.e. bool,
+	// int64 or float64) instead of strings, which can be used as is in CEL
+	// expressions (e.g. `{http.request.body.amount} > 100`). Note that typed
+	// values no longer equal strings in expressions (e.g. `== "1"`), hence
+	// it is opt-in. Defaults to false.
+	TypedValues bool `json:"typed_values,omitempty"`
+
+	querierOpts *querierOptions
+
 	logger *zap.Logger
 }
 
@@ -45,57 +124,105 @@ func (RequestBodyVar) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (rbv *RequestBodyVar) Provision(ctx caddy.Context) (err error) {
 	rbv.logger = ctx.Logger(rbv)
+	if rbv.OnOversize == "" {
+		rbv.OnOversize = "empty"
+	}
+	if rbv.MaxDecodedSize == 0 {
+		rbv.MaxDecodedSize = 10 << 20 // At most 10MiB by default
+	}
+	rbv.querierOpts = &querierOptions{
+		format:     rbv.Format,
+		mediaTypes: rbv.MediaTypes,
+		fallback:   rbv.Fallback,
+
+		queryLanguage: rbv.QueryLanguage,
+	}
+	if rbv.DescriptorSet != "" {
+		rbv.querierOpts.protoTypes, err = loadProtoTypes(rbv.DescriptorSet, rbv.MessageType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (rbv *RequestBodyVar) Validate() error {
+	if rbv.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative: %d", rbv.MaxSize)
+	}
+	if rbv.MaxDecodedSize < 0 {
+		return fmt.Errorf("max_decoded_size must not be negative: %d", rbv.MaxDecodedSize)
+	}
+	if rbv.OnOversize != "empty" && rbv.OnOversize != "error" {
+		return fmt.Errorf("unknown on_oversize: %q", rbv.OnOversize)
+	}
+	if rbv.MessageType != "" && rbv.DescriptorSet == "" {
+		return fmt.Errorf("message_type requires descriptor_set")
+	}
+	if err := validateFormats(rbv.Format, rbv.MediaTypes, rbv.Fallback, true); err != nil {
+		return err
+	}
+	if rbv.QueryLanguage != "" && !isQueryLanguage(rbv.QueryLanguage) {
+		return fmt.Errorf("unknown query_language: %q", rbv.QueryLanguage)
+	}
 	return nil
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (rbv RequestBodyVar) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	bodyVars := func(key string) (interface{}, bool) {
-		// We need to declare ctx before the use of the `goto`.
-		// See https://github.com/golang/go/issues/27165 and https://github.com/golang/go/issues/26058.
-		var ctx context.Context
+	if rbv.MaxSize > 0 && rbv.OnOversize == "error" && r.ContentLength > rbv.MaxSize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body too large: %d > %d", r.ContentLength, rbv.MaxSize))
+	}
 
+	bodyVars := func(key string) (interface{}, bool) {
 		key, ok := parseKey(key)
 		if !ok || key == "" {
 			rbv.logger.Error("invalid var", zap.String("key", key))
 			return nil, false
 		}
 
-		// First of all, try to get the value from the buffered JSON body, if any.
-		buf, ok := r.Context().Value(bodyBufferCtxKey).(*bytes.Buffer)
-		if ok {
-			rbv.logger.Debug("got from the buffer", zap.String("key", key))
-			goto Query
-		}
-
-		rbv.logger.Debug("got from the body", zap.String("key", key))
-
-		// Otherwise, try to get the value by reading the request body.
-		if r == nil || r.Body == nil {
-			return "", true
-		}
-		// Close the real body since we will replace it with a fake one.
-		defer r.Body.Close()
-
-		// Copy the request body.
-		buf = new(bytes.Buffer)
-		if _, err := io.Copy(buf, r.Body); err != nil {
-			return "", true
+		if alg := strings.TrimPrefix(key, hashKeyPrefix); alg != key {
+			if _, ok := hashes[alg]; ok {
+				return rbv.digest(r, alg), true
+			}
 		}
 
-		// Replace the real body with buffered data.
-		r.Body = ioutil.NopCloser(buf)
-
-		// Add the buffered JSON body into the context for the request.
-		ctx = context.WithValue(r.Context(), bodyBufferCtxKey, buf)
-		r = r.WithContext(ctx)
+		// Reuse the querier, if any, to avoid parsing the body repeatedly.
+		// If the body fails to be buffered, decoded or parsed, the failure
+		// is cached as well, so that it is only handled once.
+		querier, err := loadBodyCache(r).querier(newQuerierKey(rbv.MaxSize, rbv.MaxDecodedSize, rbv.querierOpts), func() (Querier, error) {
+			buf, oversize, err := bufferBody(r, rbv.MaxSize)
+			if err != nil {
+				return nil, err
+			}
+			if oversize {
+				rbv.logger.Error("request body too large",
+					zap.String("key", key),
+					zap.Int64("max_size", rbv.MaxSize),
+				)
+				return nil, fmt.Errorf("request body too large: > %d", rbv.MaxSize)
+			}
 
-	Query:
-		querier, err := newQuerier(buf, r.Header.Get("Content-Type"))
+			body, err := decodeBody(buf, r.Header.Get("Content-Encoding"), rbv.MaxDecodedSize)
+			if err != nil {
+				rbv.logger.Debug("failed to decode body", zap.String("key", key), zap.Error(err))
+				return nil, err
+			}
+			querier, err := newQuerier(body, r.Header.Get("Content-Type"), r.URL.Path, rbv.querierOpts)
+			if err != nil {
+				rbv.logger.Debug("failed to new querier", zap.String("key", key), zap.Error(err))
+				return nil, err
+			}
+			return querier, nil
+		})
 		if err != nil {
-			rbv.logger.Error("failed to new querier", zap.String("key", key), zap.Error(err))
 			return "", true
 		}
+		if rbv.TypedValues {
+			return placeholderValue(querier, key), true
+		}
 		return querier.Query(key), true
 	}
 
@@ -105,6 +232,17 @@ func (rbv RequestBodyVar) ServeHTTP(w http.ResponseWriter, r *http.Request, next
 	return next.ServeHTTP(w, r)
 }
 
+// digest returns the digest of the raw body of r (see bodyCache.digest), or
+// empty if the body is larger than MaxSize or fails to be buffered.
+func (rbv RequestBodyVar) digest(r *http.Request, alg string) string {
+	_, oversize, err := bufferBody(r, rbv.MaxSize)
+	if err != nil || oversize {
+		return ""
+	}
+	digest, _ := loadBodyCache(r).digest(alg)
+	return digest
+}
+
 func parseKey(s string) (string, bool) {
 	switch {
 	case strings.HasPrefix(s, fullReqBodyReplPrefix):
@@ -117,8 +255,255 @@ func parseKey(s string) (string, bool) {
 	}
 }
 
-// UnmarshalCaddyfile - this is a no-op
+// bodyCache caches the buffered body of a request, along with the queriers
+// and the digests of it, which is shared by all the handlers and the matchers
+// in this package through the variable table of the request.
+type bodyCache struct {
+	// The whole body, or nil if it is not buffered yet.
+	buf *bytes.Buffer
+	// Whether the body has been rewritten (by RequestBodyRewrite).
+	rewritten bool
+
+	queriers map[querierKey]querierResult
+	// The hex-encoded digests of the body, keyed by the hash algorithms.
+	digests map[string]string
+}
+
+// querierKey identifies the queriers of a body, which are created with
+// the same options.
+type querierKey struct {
+	maxSize        int64
+	maxDecodedSize int64
+
+	format        string
+	fallback      string
+	queryLanguage string
+	// The options with media types or proto types, which can not be
+	// compared by value. Nil otherwise.
+	opts *querierOptions
+}
+
+func newQuerierKey(maxSize, maxDecodedSize int64, opts *querierOptions) querierKey {
+	k := querierKey{maxSize: maxSize, maxDecodedSize: maxDecodedSize}
+	if opts == nil {
+		return k
+	}
+	k.format, k.fallback, k.queryLanguage = opts.format, opts.fallback, opts.queryLanguage
+	if len(opts.mediaTypes) > 0 || opts.protoTypes != nil {
+		k.opts = opts
+	}
+	return k
+}
+
+type querierResult struct {
+	querier Querier
+	err     error
+}
+
+// loadBodyCache returns the bodyCache of r. If r has no variable table
+// (which is always created by Caddy), nothing will be cached.
+func loadBodyCache(r *http.Request) *bodyCache {
+	c, ok := caddyhttp.GetVar(r.Context(), bodyCacheVarKey).(*bodyCache)
+	if !ok {
+		c = new(bodyCache)
+		caddyhttp.SetVar(r.Context(), bodyCacheVarKey, c)
+	}
+	return c
+}
+
+// querier returns the querier cached with key, or the one (along with
+// the error) returned by newQuerier, which is then cached.
+func (c *bodyCache) querier(key querierKey, newQuerier func() (Querier, error)) (Querier, error) {
+	if result, ok := c.queriers[key]; ok {
+		return result.querier, result.err
+	}
+	querier, err := newQuerier()
+	if c.queriers == nil {
+		c.queriers = make(map[querierKey]querierResult)
+	}
+	c.queriers[key] = querierResult{querier: querier, err: err}
+	return querier, err
+}
+
+// digest returns the hex-encoded digest of the buffered body, which must not
+// be nil, by using the hash algorithm alg (see hashes). The digest is computed
+// once and cached. It returns false if alg is unknown.
+func (c *bodyCache) digest(alg string) (string, bool) {
+	if digest, ok := c.digests[alg]; ok {
+		return digest, true
+	}
+	newHash, ok := hashes[alg]
+	if !ok {
+		return "", false
+	}
+	hasher := newHash()
+	hasher.Write(c.buf.Bytes())
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	if c.digests == nil {
+		c.digests = make(map[string]string)
+	}
+	c.digests[alg] = digest
+	return digest, true
+}
+
+// reset replaces the buffered body with the rewritten one buf, and drops all
+// the queriers and the digests of the old one.
+func (c *bodyCache) reset(buf *bytes.Buffer) {
+	c.buf = buf
+	c.rewritten = true
+	c.queriers = nil
+	c.digests = nil
+}
+
+// bufferBody copies the body of r into a buffer, or at most maxSize+1 bytes
+// of it if maxSize is positive, and reports whether the body is larger than
+// maxSize. The body is always restored for the next handlers.
+//
+// The whole body, once buffered, is cached for the request, and is reused
+// by the later calls.
+func bufferBody(r *http.Request, maxSize int64) (buf *bytes.Buffer, oversize bool, err error) {
+	c := loadBodyCache(r)
+	if c.buf != nil {
+		return c.buf, maxSize > 0 && int64(c.buf.Len()) > maxSize, nil
+	}
+	if r.Body == nil {
+		return nil, false, fmt.Errorf("no body")
+	}
+
+	buf = new(bytes.Buffer)
+	src := io.Reader(r.Body)
+	if maxSize > 0 {
+		src = io.LimitReader(r.Body, maxSize+1)
+	}
+	_, err = io.Copy(buf, src)
+
+	// Restore the body by prepending the data already read to the unread
+	// part (if any) of the real body.
+	r.Body = readCloser{
+		Reader: io.MultiReader(bytes.NewReader(buf.Bytes()), r.Body),
+		Closer: r.Body,
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+	if maxSize > 0 && int64(buf.Len()) > maxSize {
+		return buf, true, nil
+	}
+	c.buf = buf
+	return buf, false, nil
+}
+
+// readCloser combines a reader and a closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//     request_body_var {
+//         max_size    <size>
+//         on_oversize empty|error
+//
+//         max_decoded_size <size>
+//
+//         descriptor_set <file>
+//         message_type   <name>
+//
+//         format     <format>
+//         media_type <media_type> <format>
+//         fallback   <format>
+//
+//         query_language gjson|jsonpath|jmespath
+//         typed_values
+//     }
+//
 func (rbv *RequestBodyVar) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "max_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_size value %s: %v", d.Val(), err)
+				}
+				rbv.MaxSize = int64(size)
+
+			case "on_oversize":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.OnOversize = d.Val()
+
+			case "max_decoded_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_decoded_size value %s: %v", d.Val(), err)
+				}
+				rbv.MaxDecodedSize = int64(size)
+
+			case "descriptor_set":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.DescriptorSet = d.Val()
+
+			case "message_type":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.MessageType = d.Val()
+
+			case "format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.Format = d.Val()
+
+			case "media_type":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if rbv.MediaTypes == nil {
+					rbv.MediaTypes = make(map[string]string)
+				}
+				rbv.MediaTypes[args[0]] = args[1]
+
+			case "fallback":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.Fallback = d.Val()
+
+			case "query_language":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.QueryLanguage = d.Val()
+
+			case "typed_values":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.TypedValues = true
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
 	return nil
 }
 
@@ -134,6 +519,8 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 
 // Interface guards
 var (
+	_ caddy.Provisioner           = (*RequestBodyVar)(nil)
+	_ caddy.Validator             = (*RequestBodyVar)(nil)
 	_ caddyhttp.MiddlewareHandler = (*RequestBodyVar)(nil)
 	_ caddyfile.Unmarshaler       = (*RequestBodyVar)(nil)
 )
@@ -0,0 +1,267 @@
+package requestbodyvar
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestBodyVar_ServeHTTP(t *testing.T) {
+	cases := []struct {
+		name          string
+		inRBV         RequestBodyVar
+		inContentType string
+		inBody        string
+		inChunked     bool
+		wantValue     string
+		wantBody      string
+		wantErrStatus int
+	}{
+		{
+			name:      "no limit",
+			inRBV:     RequestBodyVar{OnOversize: "empty"},
+			inBody:    `{"name":"caddy"}`,
+			wantValue: "caddy",
+			wantBody:  `{"name":"caddy"}`,
+		},
+		{
+			name:          "xml",
+			inRBV:         RequestBodyVar{OnOversize: "empty"},
+			inContentType: "application/xml",
+			inBody:        `<name>caddy</name>`,
+			wantValue:     "caddy",
+			wantBody:      `<name>caddy</name>`,
+		},
+		{
+			name:      "within limit",
+			inRBV:     RequestBodyVar{MaxSize: 16, OnOversize: "empty"},
+			inBody:    `{"name":"caddy"}`,
+			wantValue: "caddy",
+			wantBody:  `{"name":"caddy"}`,
+		},
+		{
+			name:      "over limit",
+			inRBV:     RequestBodyVar{MaxSize: 10, OnOversize: "empty"},
+			inBody:    `{"name":"caddy"}`,
+			wantValue: "",
+			wantBody:  `{"name":"caddy"}`,
+		},
+		{
+			name:          "over limit with error",
+			inRBV:         RequestBodyVar{MaxSize: 10, OnOversize: "error"},
+			inBody:        `{"name":"caddy"}`,
+			wantErrStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:      "over limit with error and unknown length",
+			inRBV:     RequestBodyVar{MaxSize: 10, OnOversize: "error"},
+			inBody:    `{"name":"caddy"}`,
+			inChunked: true,
+			wantValue: "",
+			wantBody:  `{"name":"caddy"}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.inRBV.logger = zap.NewNop()
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.inBody))
+			if c.inContentType != "" {
+				req.Header.Set("Content-Type", c.inContentType)
+			}
+			if c.inChunked {
+				req.ContentLength = -1
+			}
+			repl := caddyhttp.NewTestReplacer(req)
+			req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+
+			var gotValue, gotBody string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				// Resolve the placeholder twice to cover the buffered case.
+				_ = repl.ReplaceAll("{http.request.body.name}", "")
+				gotValue = repl.ReplaceAll("{http.request.body.name}", "")
+
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				gotBody = string(body)
+				return nil
+			})
+
+			err := c.inRBV.ServeHTTP(httptest.NewRecorder(), req, next)
+			if c.wantErrStatus != 0 {
+				if handlerErr, ok := err.(caddyhttp.HandlerError); !ok || handlerErr.StatusCode != c.wantErrStatus {
+					t.Fatalf("Err: got (%#v), want status (%#v)", err, c.wantErrStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			if gotValue != c.wantValue {
+				t.Fatalf("Value: got (%#v), want (%#v)", gotValue, c.wantValue)
+			}
+			if gotBody != c.wantBody {
+				t.Fatalf("Body: got (%#v), want (%#v)", gotBody, c.wantBody)
+			}
+		})
+	}
+}
+
+// withVars returns a copy of r with the variable table, which is always
+// created by Caddy for a request.
+func withVars(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, make(map[string]interface{})))
+}
+
+func TestRequestBodyVar_ServeHTTP_decodeFailure(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	rbv := RequestBodyVar{OnOversize: "empty", logger: zap.New(core)}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`not gzip`))
+	req.Header.Set("Content-Encoding", "gzip")
+	repl := caddyhttp.NewTestReplacer(req)
+	req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+
+	var gotValues []string
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		for i := 0; i < 3; i++ {
+			gotValues = append(gotValues, repl.ReplaceAll("{http.request.body.name}", ""))
+		}
+		return nil
+	})
+	if err := rbv.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	wantValues := []string{"", "", ""}
+	if !reflect.DeepEqual(gotValues, wantValues) {
+		t.Fatalf("Values: got (%#v), want (%#v)", gotValues, wantValues)
+	}
+
+	// The failure is cached, thus only logged once.
+	failures := logs.FilterMessage("failed to decode body")
+	if got := failures.Len(); got != 1 {
+		t.Fatalf("Failures: got (%#v), want (%#v)", got, 1)
+	}
+	if got := failures.All()[0].Level; got != zap.DebugLevel {
+		t.Fatalf("Level: got (%#v), want (%#v)", got, zap.DebugLevel)
+	}
+}
+
+func TestRequestBodyVar_ServeHTTP_hash(t *testing.T) {
+	const body = "hello"
+
+	cases := []struct {
+		name      string
+		inRBV     RequestBodyVar
+		wantValue string
+	}{
+		{
+			name:      "sha256",
+			inRBV:     RequestBodyVar{OnOversize: "empty"},
+			wantValue: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		},
+		{
+			name:      "over max size",
+			inRBV:     RequestBodyVar{MaxSize: 2, OnOversize: "empty"},
+			wantValue: "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rbv := c.inRBV
+			rbv.logger = zap.NewNop()
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			req.Header.Set("Content-Type", "text/plain")
+			repl := caddyhttp.NewTestReplacer(req)
+			req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+
+			var gotValues []string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				gotValues = append(gotValues,
+					repl.ReplaceAll("{http.request.body.hash.sha256}", ""),
+					repl.ReplaceAll("{body.hash.sha256}", ""),
+				)
+				return nil
+			})
+			if err := rbv.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			wantValues := []string{c.wantValue, c.wantValue}
+			if !reflect.DeepEqual(gotValues, wantValues) {
+				t.Fatalf("Values: got (%#v), want (%#v)", gotValues, wantValues)
+			}
+			if c.wantValue == "" {
+				return
+			}
+			// The digest is cached.
+			if got := loadBodyCache(req).digests["sha256"]; got != c.wantValue {
+				t.Fatalf("Cached digest: got (%#v), want (%#v)", got, c.wantValue)
+			}
+		})
+	}
+}
+
+func BenchmarkRequestBodyVar_ServeHTTP(b *testing.B) {
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `{"user":{"name":{"first":"Janet","last":"Prichard"},"age":47,"email":"janet@example.com","city":"Paris"}}`,
+		},
+		{
+			name:        "xml",
+			contentType: "application/xml",
+			body:        `<user><name><first>Janet</first><last>Prichard</last></name><age>47</age><email>janet@example.com</email><city>Paris</city></user>`,
+		},
+	}
+	keys := []string{
+		"{body.user.name.first}",
+		"{body.user.name.last}",
+		"{body.user.age}",
+		"{body.user.email}",
+		"{body.user.city}",
+	}
+
+	rbv := RequestBodyVar{OnOversize: "empty", logger: zap.NewNop()}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		for _, key := range keys {
+			_ = repl.ReplaceAll(key, "")
+		}
+		return nil
+	})
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body))
+				req.Header.Set("Content-Type", c.contentType)
+				repl := caddyhttp.NewTestReplacer(req)
+				req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+				_ = rbv.ServeHTTP(httptest.NewRecorder(), req, next)
+			}
+		})
+	}
+}
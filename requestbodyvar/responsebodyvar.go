@@ -0,0 +1,356 @@
+package requestbodyvar
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"go.uber.org/zap"
+)
+
+const respBodyReplPrefix = "http.response.body."
+
+func init() {
+	caddy.RegisterModule(ResponseBodyVar{})
+	httpcaddyfile.RegisterHandlerDirective("response_body_var", parseResponseCaddyfile)
+}
+
+// ResponseBodyVar implements an HTTP handler that replaces {http.response.body.*}
+// with the value of the given field from the response body written by the
+// next handlers, if any.
+//
+// The response is buffered until the next handlers return, and is then
+// written unchanged. Therefore, the placeholders are only available after
+// that, e.g. in access logs or in deferred header operations of the
+// `header` handlers placed before this handler.
+type ResponseBodyVar struct {
+	// The maximum size (in bytes) of the response body to buffer. If the
+	// body is larger (or is flushed by the next handlers, see
+	// BufferMediaTypes), it will be written through without buffering,
+	// and the placeholders will resolve to empty. Defaults to 1MiB.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// The media types (e.g. `application/json`) of the responses whose
+	// flushes by the next handlers are ignored while buffering, which is
+	// useful for handlers flushing after every write (e.g. `reverse_proxy`
+	// with a negative `flush_interval`). Responses of other media types
+	// stop buffering at the first flush, so that streams (e.g. server-sent
+	// events, gRPC or NDJSON) are not held back. Defaults to none.
+	BufferMediaTypes []string `json:"buffer_media_types,omitempty"`
+
+	// The maximum size (in bytes) of the decoded response body, if the body
+	// is compressed. Defaults to 10MiB. See RequestBodyVar.MaxDecodedSize.
+	MaxDecodedSize int64 `json:"max_decoded_size,omitempty"`
+
+	// The query language of the placeholder keys. Defaults to `gjson`.
+	// See RequestBodyVar.QueryLanguage.
+	QueryLanguage string `json:"query_language,omitempty"`
+
+	// Whether to provide booleans and numbers as typed values.
+	// See RequestBodyVar.TypedValues.
+	TypedValues bool `json:"typed_values,omitempty"`
+
+	querierOpts *querierOptions
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (ResponseBodyVar) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.response_body_var",
+		New: func() caddy.Module { return new(ResponseBodyVar) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (rbv *ResponseBodyVar) Provision(ctx caddy.Context) error {
+	rbv.logger = ctx.Logger(rbv)
+	rbv.provision()
+	return nil
+}
+
+func (rbv *ResponseBodyVar) provision() {
+	if rbv.MaxSize == 0 {
+		rbv.MaxSize = 1 << 20 // At most 1MiB by default
+	}
+	if rbv.MaxDecodedSize == 0 {
+		rbv.MaxDecodedSize = 10 << 20 // At most 10MiB by default
+	}
+	rbv.querierOpts = &querierOptions{queryLanguage: rbv.QueryLanguage}
+}
+
+// Validate implements caddy.Validator.
+func (rbv *ResponseBodyVar) Validate() error {
+	if rbv.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative: %d", rbv.MaxSize)
+	}
+	if rbv.MaxDecodedSize < 0 {
+		return fmt.Errorf("max_decoded_size must not be negative: %d", rbv.MaxDecodedSize)
+	}
+	if rbv.QueryLanguage != "" && !isQueryLanguage(rbv.QueryLanguage) {
+		return fmt.Errorf("unknown query_language: %q", rbv.QueryLanguage)
+	}
+	for _, mediaType := range rbv.BufferMediaTypes {
+		if _, _, err := mime.ParseMediaType(mediaType); err != nil {
+			return fmt.Errorf("bad buffer_media_types value %s: %v", mediaType, err)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (rbv ResponseBodyVar) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	rb := &responseBuffer{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		maxSize:               rbv.MaxSize,
+		bufferMediaTypes:      rbv.BufferMediaTypes,
+		buf:                   new(bytes.Buffer),
+	}
+
+	var (
+		done    bool
+		once    sync.Once
+		querier Querier
+	)
+	bodyVars := func(key string) (interface{}, bool) {
+		if !strings.HasPrefix(key, respBodyReplPrefix) {
+			return nil, false
+		}
+		key = key[len(respBodyReplPrefix):]
+
+		// The response body is incomplete until the next handlers return.
+		if !done || rb.passThrough {
+			return "", true
+		}
+
+		// Parse the response body once, at the first query.
+		once.Do(func() {
+			body, err := decodeBody(rb.buf, rb.Header().Get("Content-Encoding"), rbv.MaxDecodedSize)
+			if err != nil {
+				rbv.logger.Error("failed to decode response body", zap.Error(err))
+				return
+			}
+			querier, err = newQuerier(body, rb.Header().Get("Content-Type"), r.URL.Path, rbv.querierOpts)
+			if err != nil {
+				rbv.logger.Error("failed to new querier", zap.Error(err))
+			}
+		})
+		if querier == nil {
+			return "", true
+		}
+		if rbv.TypedValues {
+			return placeholderValue(querier, key), true
+		}
+		return querier.Query(key), true
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Map(bodyVars)
+
+	if err := next.ServeHTTP(rb, r); err != nil {
+		return err
+	}
+
+	done = true
+	return rb.flush()
+}
+
+// responseBuffer buffers the response, which is size-capped, until flush is
+// called. If the response is too large or is flushed explicitly (unless it
+// is one of bufferMediaTypes), it will be written through from then on.
+type responseBuffer struct {
+	*caddyhttp.ResponseWriterWrapper
+
+	maxSize          int64
+	bufferMediaTypes []string
+	buf              *bytes.Buffer
+	status      int
+	wroteHeader bool
+	passThrough bool
+}
+
+func (rb *responseBuffer) WriteHeader(status int) {
+	if rb.wroteHeader {
+		return
+	}
+	rb.wroteHeader = true
+	rb.status = status
+
+	if rb.passThrough {
+		rb.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	if !rb.wroteHeader {
+		rb.WriteHeader(http.StatusOK)
+	}
+	if !rb.passThrough && rb.maxSize > 0 && int64(rb.buf.Len()+len(p)) > rb.maxSize {
+		if err := rb.stopBuffering(); err != nil {
+			return 0, err
+		}
+	}
+	if rb.passThrough {
+		return rb.ResponseWriter.Write(p)
+	}
+	return rb.buf.Write(p)
+}
+
+// Flush implements http.Flusher. While buffering, a flush stops buffering,
+// unless the response is one of bufferMediaTypes.
+func (rb *responseBuffer) Flush() {
+	if !rb.passThrough {
+		if rb.ignoresFlush() {
+			return
+		}
+		if err := rb.stopBuffering(); err != nil {
+			return
+		}
+	}
+	rb.ResponseWriterWrapper.Flush()
+}
+
+// ignoresFlush reports whether the media type of the response is one of
+// bufferMediaTypes.
+func (rb *responseBuffer) ignoresFlush() bool {
+	if len(rb.bufferMediaTypes) == 0 {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(rb.Header().Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range rb.bufferMediaTypes {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hijack implements http.Hijacker.
+func (rb *responseBuffer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	// The hijacked connection is managed by the next handlers from now on.
+	rb.passThrough = true
+	return rb.ResponseWriterWrapper.Hijack()
+}
+
+// stopBuffering writes the header and the buffered data, if any, and makes
+// the subsequent writes pass through.
+func (rb *responseBuffer) stopBuffering() error {
+	rb.passThrough = true
+	if rb.wroteHeader {
+		rb.ResponseWriter.WriteHeader(rb.status)
+	}
+	if rb.buf.Len() == 0 {
+		return nil
+	}
+	_, err := rb.ResponseWriter.Write(rb.buf.Bytes())
+	return err
+}
+
+// flush writes the buffered response, if any.
+func (rb *responseBuffer) flush() error {
+	if rb.passThrough || !rb.wroteHeader {
+		return nil
+	}
+	rb.ResponseWriter.WriteHeader(rb.status)
+	_, err := rb.ResponseWriter.Write(rb.buf.Bytes())
+	return err
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//     response_body_var {
+//         max_size           <size>
+//         buffer_media_types <media_type...>
+//         max_decoded_size   <size>
+//         query_language     gjson|jsonpath|jmespath
+//         typed_values
+//     }
+//
+func (rbv *ResponseBodyVar) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "max_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_size value %s: %v", d.Val(), err)
+				}
+				rbv.MaxSize = int64(size)
+
+			case "buffer_media_types":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				rbv.BufferMediaTypes = append(rbv.BufferMediaTypes, args...)
+
+			case "max_decoded_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_decoded_size value %s: %v", d.Val(), err)
+				}
+				rbv.MaxDecodedSize = int64(size)
+
+			case "query_language":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.QueryLanguage = d.Val()
+
+			case "typed_values":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				rbv.TypedValues = true
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseResponseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	rbv := new(ResponseBodyVar)
+	err := rbv.UnmarshalCaddyfile(h.Dispenser)
+	if err != nil {
+		return nil, err
+	}
+
+	return rbv, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*ResponseBodyVar)(nil)
+	_ caddy.Validator             = (*ResponseBodyVar)(nil)
+	_ caddyhttp.MiddlewareHandler = (*ResponseBodyVar)(nil)
+	_ caddyfile.Unmarshaler       = (*ResponseBodyVar)(nil)
+	_ http.Flusher                = (*responseBuffer)(nil)
+	_ http.Hijacker               = (*responseBuffer)(nil)
+)
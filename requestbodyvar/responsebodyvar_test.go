@@ -0,0 +1,135 @@
+package requestbodyvar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestResponseBodyVar_ServeHTTP(t *testing.T) {
+	body := `{"user":{"id":42,"name":"caddy"}}`
+
+	cases := []struct {
+		name          string
+		inRBV         *ResponseBodyVar
+		inContentType string
+		inFlush       bool
+		wantValue     string
+		wantFlushed   bool
+	}{
+		{
+			name:          "json",
+			inRBV:         &ResponseBodyVar{},
+			inContentType: "application/json",
+			wantValue:     "42",
+		},
+		{
+			name:          "jmespath",
+			inRBV:         &ResponseBodyVar{QueryLanguage: langJMESPath},
+			inContentType: "application/json; charset=utf-8",
+			wantValue:     "42",
+		},
+		{
+			name:          "over max size",
+			inRBV:         &ResponseBodyVar{MaxSize: 10},
+			inContentType: "application/json",
+			wantValue:     "",
+		},
+		{
+			name:          "flushed",
+			inRBV:         &ResponseBodyVar{},
+			inContentType: "application/json",
+			inFlush:       true,
+			wantValue:     "",
+			wantFlushed:   true,
+		},
+		{
+			name:          "flushed buffered media type",
+			inRBV:         &ResponseBodyVar{BufferMediaTypes: []string{"application/json"}},
+			inContentType: "application/json; charset=utf-8",
+			inFlush:       true,
+			wantValue:     "42",
+		},
+		{
+			name:          "flushed over max size",
+			inRBV:         &ResponseBodyVar{MaxSize: 10, BufferMediaTypes: []string{"application/json"}},
+			inContentType: "application/json",
+			inFlush:       true,
+			wantValue:     "",
+			wantFlushed:   true,
+		},
+		{
+			name:          "flushed event stream",
+			inRBV:         &ResponseBodyVar{},
+			inContentType: "text/event-stream",
+			inFlush:       true,
+			wantValue:     "",
+			wantFlushed:   true,
+		},
+		{
+			name:          "unsupported media type",
+			inRBV:         &ResponseBodyVar{},
+			inContentType: "text/plain",
+			wantValue:     "",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.inRBV.logger = zap.NewNop()
+			c.inRBV.provision()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			repl := caddyhttp.NewTestReplacer(req)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl))
+
+			var valueInNext string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", c.inContentType)
+				w.WriteHeader(http.StatusCreated)
+				for _, p := range []string{body[:10], body[10:]} {
+					if _, err := w.Write([]byte(p)); err != nil {
+						return err
+					}
+					// Flush after every write, as reverse_proxy does with
+					// a negative flush_interval.
+					if c.inFlush {
+						w.(http.Flusher).Flush()
+					}
+				}
+				// The response body is incomplete yet.
+				valueInNext = repl.ReplaceAll("{http.response.body.user.id}", "")
+				return nil
+			})
+
+			w := httptest.NewRecorder()
+			if err := c.inRBV.ServeHTTP(w, req, next); err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			if valueInNext != "" {
+				t.Fatalf("Value in next: got (%#v), want (%#v)", valueInNext, "")
+			}
+			value := repl.ReplaceAll("{http.response.body.user.id}", "")
+			if value != c.wantValue {
+				t.Fatalf("Value: got (%#v), want (%#v)", value, c.wantValue)
+			}
+
+			// The response must be written unchanged.
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Status: got (%#v), want (%#v)", w.Code, http.StatusCreated)
+			}
+			if w.Body.String() != body {
+				t.Fatalf("Body: got (%#v), want (%#v)", w.Body.String(), body)
+			}
+			if w.Flushed != c.wantFlushed {
+				t.Fatalf("Flushed: got (%#v), want (%#v)", w.Flushed, c.wantFlushed)
+			}
+		})
+	}
+}
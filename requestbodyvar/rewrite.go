@@ -0,0 +1,396 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(RequestBodyRewrite{})
+	httpcaddyfile.RegisterHandlerDirective("request_body_rewrite", parseRewriteCaddyfile)
+}
+
+// Operations of body rewriting.
+const (
+	rewriteSet    = "set"
+	rewriteSetRaw = "set_raw"
+	rewriteDelete = "delete"
+	rewriteRename = "rename"
+)
+
+// RewriteOp is an operation on a field in the JSON request body.
+type RewriteOp struct {
+	// The operation, which is one of:
+	//
+	// - `set`: set the field to the string Value.
+	// - `set_raw`: set the field to the raw JSON Value (e.g. `1` or `[1, 2]`).
+	// - `delete`: delete the field.
+	// - `rename`: move the field, if any, to the path Value.
+	Op string `json:"op,omitempty"`
+
+	// The path of the field in the gjson path syntax (e.g. `user.name`).
+	Path string `json:"path,omitempty"`
+
+	// The operand of Op. Placeholders are supported for `set` and `set_raw`.
+	Value string `json:"value,omitempty"`
+}
+
+// errInvalidValue is returned by RewriteOp.apply if the value of `set_raw`
+// is invalid JSON once the placeholders (e.g. of the request headers) are
+// expanded, which is caused by the client.
+var errInvalidValue = errors.New("invalid JSON value")
+
+// apply applies the operation to the JSON document data.
+func (o *RewriteOp) apply(data []byte, repl *caddy.Replacer) ([]byte, error) {
+	switch o.Op {
+	case rewriteSet:
+		return sjson.SetBytes(data, o.Path, repl.ReplaceAll(o.Value, ""))
+	case rewriteSetRaw:
+		value := repl.ReplaceAll(o.Value, "")
+		if !gjson.Valid(value) {
+			return nil, fmt.Errorf("%w for path %s: %q", errInvalidValue, o.Path, value)
+		}
+		return sjson.SetRawBytes(data, o.Path, []byte(value))
+	case rewriteDelete:
+		return sjson.DeleteBytes(data, o.Path)
+	case rewriteRename:
+		value := gjson.GetBytes(data, o.Path)
+		if !value.Exists() {
+			return data, nil
+		}
+		data, err := sjson.DeleteBytes(data, o.Path)
+		if err != nil {
+			return nil, err
+		}
+		return sjson.SetRawBytes(data, o.Value, []byte(value.Raw))
+	default:
+		return nil, fmt.Errorf("unknown op: %q", o.Op)
+	}
+}
+
+// RequestBodyRewrite implements an HTTP handler that rewrites the fields
+// of JSON request bodies. Bodies in other formats are rejected with 415
+// (Unsupported Media Type) by default (see OnNonJSON), while invalid JSON
+// bodies, including those with duplicate keys in an object, are rejected
+// with 400 (Bad Request).
+//
+// The request is also rejected with 400 if a `set_raw` value is invalid JSON
+// once its placeholders are expanded, or with 500 (Internal Server Error) if
+// an operation fails otherwise (e.g. for a bad path).
+//
+// The `{http.request.body.*}` placeholders and the `body` matchers resolve
+// from the rewritten body once this handler is in effect, no matter where
+// RequestBodyVar is placed.
+type RequestBodyRewrite struct {
+	// The operations, which are applied in order.
+	Ops []*RewriteOp `json:"ops,omitempty"`
+
+	// What to do with non-empty request bodies whose `Content-Type` is not
+	// of JSON:
+	//
+	// - `pass`: pass them to the next handler unchanged.
+	// - `error`: respond with 415 (Unsupported Media Type).
+	//
+	// Defaults to `error`. Note that with `pass`, a client can bypass all
+	// the operations by sending a JSON body with another `Content-Type`,
+	// which some backends accept as JSON anyway.
+	OnNonJSON string `json:"on_non_json,omitempty"`
+
+	// The maximum size (in bytes) of the request body to buffer. If the body
+	// is larger, the request will be rejected with 413 (Request Entity Too
+	// Large). Defaults to 0 (i.e. no limit).
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// The maximum size (in bytes) of the decoded request body, if the body
+	// is compressed. Defaults to 10MiB. See RequestBodyVar.MaxDecodedSize.
+	//
+	// Note that the rewritten body is always uncompressed.
+	MaxDecodedSize int64 `json:"max_decoded_size,omitempty"`
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (RequestBodyRewrite) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.request_body_rewrite",
+		New: func() caddy.Module { return new(RequestBodyRewrite) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (rw *RequestBodyRewrite) Provision(ctx caddy.Context) error {
+	rw.logger = ctx.Logger(rw)
+	if rw.OnNonJSON == "" {
+		rw.OnNonJSON = "error"
+	}
+	if rw.MaxDecodedSize == 0 {
+		rw.MaxDecodedSize = 10 << 20 // At most 10MiB by default
+	}
+	return nil
+}
+
+// Validate implements caddy.Validator.
+func (rw *RequestBodyRewrite) Validate() error {
+	if len(rw.Ops) == 0 {
+		return fmt.Errorf("no ops")
+	}
+	for _, o := range rw.Ops {
+		switch o.Op {
+		case rewriteSet, rewriteDelete:
+		case rewriteSetRaw:
+			// Values with placeholders can only be checked once expanded.
+			if !strings.Contains(o.Value, "{") && !gjson.Valid(o.Value) {
+				return fmt.Errorf("invalid JSON value for path %s: %q", o.Path, o.Value)
+			}
+		case rewriteRename:
+			if o.Value == "" {
+				return fmt.Errorf("empty new path for renaming %s", o.Path)
+			}
+		default:
+			return fmt.Errorf("unknown op for path %s: %q", o.Path, o.Op)
+		}
+		if o.Path == "" {
+			return fmt.Errorf("empty path for op %s", o.Op)
+		}
+	}
+	if rw.OnNonJSON != "pass" && rw.OnNonJSON != "error" {
+		return fmt.Errorf("unknown on_non_json: %q", rw.OnNonJSON)
+	}
+	if rw.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative: %d", rw.MaxSize)
+	}
+	if rw.MaxDecodedSize < 0 {
+		return fmt.Errorf("max_decoded_size must not be negative: %d", rw.MaxDecodedSize)
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (rw RequestBodyRewrite) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return next.ServeHTTP(w, r)
+	}
+	if contentType := r.Header.Get("Content-Type"); !isJSONContentType(contentType) {
+		if rw.OnNonJSON != "pass" && r.ContentLength != 0 {
+			return caddyhttp.Error(http.StatusUnsupportedMediaType,
+				fmt.Errorf("unsupported Media Type for rewriting: %q", contentType))
+		}
+		return next.ServeHTTP(w, r)
+	}
+
+	// The buffered body is shared with the other handlers (e.g.
+	// RequestBodyVar) and matchers.
+	buf, oversize, err := bufferBody(r, rw.MaxSize)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if oversize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body too large: > %d", rw.MaxSize))
+	}
+	if buf.Len() == 0 {
+		return next.ServeHTTP(w, r)
+	}
+
+	encoding := r.Header.Get("Content-Encoding")
+	body, err := decodeBody(buf, encoding, rw.MaxDecodedSize)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	data := body.Bytes()
+	if !gjson.ValidBytes(data) {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid JSON body"))
+	}
+	// The operations only apply to the first one of duplicate keys, while
+	// the backend may use another one (e.g. the last one).
+	if err := checkDuplicateKeys(data); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	for _, o := range rw.Ops {
+		if data, err = o.apply(data, repl); err != nil {
+			if errors.Is(err, errInvalidValue) {
+				return caddyhttp.Error(http.StatusBadRequest, err)
+			}
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+	}
+
+	// Replace the body with the rewritten one, which is always uncompressed.
+	if encoding != "" {
+		r.Header.Del("Content-Encoding")
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	r.TransferEncoding = nil
+
+	// Make the other handlers (e.g. RequestBodyVar) and matchers see
+	// the rewritten body.
+	loadBodyCache(r).reset(bytes.NewBuffer(data))
+	return next.ServeHTTP(w, r)
+}
+
+// checkDuplicateKeys returns an error if any object in the valid JSON
+// document data has duplicate keys.
+func checkDuplicateKeys(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return checkDuplicateKeysOfValue(dec)
+}
+
+// checkDuplicateKeysOfValue checks the next value from dec, recursively.
+func checkDuplicateKeysOfValue(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		keys := make(map[string]bool)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := tok.(string)
+			if keys[key] {
+				return fmt.Errorf("duplicate key in JSON body: %q", key)
+			}
+			keys[key] = true
+			if err := checkDuplicateKeysOfValue(dec); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for dec.More() {
+			if err := checkDuplicateKeysOfValue(dec); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	// Consume the closing delimiter.
+	_, err = dec.Token()
+	return err
+}
+
+// isJSONContentType reports whether contentType (defaults to JSON) is of
+// JSON, including the `+json` structured syntax suffix.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//     request_body_rewrite {
+//         set     <path> <value>
+//         set_raw <path> <json>
+//         delete  <path>
+//         rename  <path> <new_path>
+//
+//         on_non_json      pass|error
+//         max_size         <size>
+//         max_decoded_size <size>
+//     }
+//
+func (rw *RequestBodyRewrite) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch op := d.Val(); op {
+			case rewriteSet, rewriteSetRaw, rewriteRename:
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				rw.Ops = append(rw.Ops, &RewriteOp{Op: op, Path: args[0], Value: args[1]})
+
+			case rewriteDelete:
+				args := d.RemainingArgs()
+				if len(args) != 1 {
+					return d.ArgErr()
+				}
+				rw.Ops = append(rw.Ops, &RewriteOp{Op: op, Path: args[0]})
+
+			case "on_non_json":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rw.OnNonJSON = d.Val()
+
+			case "max_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_size value %s: %v", d.Val(), err)
+				}
+				rw.MaxSize = int64(size)
+
+			case "max_decoded_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_decoded_size value %s: %v", d.Val(), err)
+				}
+				rw.MaxDecodedSize = int64(size)
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseRewriteCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	rw := new(RequestBodyRewrite)
+	err := rw.UnmarshalCaddyfile(h.Dispenser)
+	if err != nil {
+		return nil, err
+	}
+
+	return rw, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*RequestBodyRewrite)(nil)
+	_ caddy.Validator             = (*RequestBodyRewrite)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RequestBodyRewrite)(nil)
+	_ caddyfile.Unmarshaler       = (*RequestBodyRewrite)(nil)
+)
@@ -0,0 +1,242 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestRequestBodyRewrite_ServeHTTP(t *testing.T) {
+	ops := []*RewriteOp{
+		{Op: "delete", Path: "is_admin"},
+		{Op: "set", Path: "tenant_id", Value: "{http.request.header.X-Tenant-Id}"},
+		{Op: "set_raw", Path: "meta.tags", Value: `["a","b"]`},
+		{Op: "rename", Path: "user_name", Value: "user.name"},
+		{Op: "rename", Path: "unknown", Value: "known"},
+	}
+
+	cases := []struct {
+		name          string
+		inRW          *RequestBodyRewrite
+		inBody        string
+		inContentType string
+		inEncoding    string
+		inBuffered    bool
+		wantErrStatus int
+		wantBody      string
+	}{
+		{
+			name:     "json",
+			inRW:     &RequestBodyRewrite{Ops: ops},
+			inBody:   `{"user_name":"caddy","is_admin":true}`,
+			wantBody: `{"user":{"name":"caddy"},"meta":{"tags":["a","b"]},"tenant_id":"t1"}`,
+		},
+		{
+			name:          "json with structured syntax suffix",
+			inRW:          &RequestBodyRewrite{Ops: ops[:1]},
+			inBody:        `{"user_name":"caddy","is_admin":true}`,
+			inContentType: "application/vnd.api+json",
+			wantBody:      `{"user_name":"caddy"}`,
+		},
+		{
+			name:       "gzip",
+			inRW:       &RequestBodyRewrite{Ops: ops[:1]},
+			inBody:     encode(t, `{"user_name":"caddy","is_admin":true}`, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }),
+			inEncoding: "gzip",
+			wantBody:   `{"user_name":"caddy"}`,
+		},
+		{
+			name:       "buffered body",
+			inRW:       &RequestBodyRewrite{Ops: ops[:1]},
+			inBody:     `{"user_name":"caddy","is_admin":true}`,
+			inBuffered: true,
+			wantBody:   `{"user_name":"caddy"}`,
+		},
+		{
+			name:          "not json",
+			inRW:          &RequestBodyRewrite{Ops: ops},
+			inBody:        `is_admin=true`,
+			inContentType: "application/x-www-form-urlencoded",
+			wantErrStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:          "not json with pass",
+			inRW:          &RequestBodyRewrite{Ops: ops, OnNonJSON: "pass"},
+			inBody:        `is_admin=true`,
+			inContentType: "application/x-www-form-urlencoded",
+			wantBody:      `is_admin=true`,
+		},
+		{
+			name:          "not json with error",
+			inRW:          &RequestBodyRewrite{Ops: ops, OnNonJSON: "error"},
+			inBody:        `is_admin=true`,
+			inContentType: "application/x-www-form-urlencoded",
+			wantErrStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:          "empty body not json with error",
+			inRW:          &RequestBodyRewrite{Ops: ops, OnNonJSON: "error"},
+			inBody:        "",
+			inContentType: "text/plain",
+			wantBody:      "",
+		},
+		{
+			name:          "duplicate keys",
+			inRW:          &RequestBodyRewrite{Ops: ops},
+			inBody:        `{"is_admin":false,"tenant_id":"t1","is_admin":true,"tenant_id":"evil"}`,
+			wantErrStatus: http.StatusBadRequest,
+		},
+		{
+			name:          "duplicate keys in nested object",
+			inRW:          &RequestBodyRewrite{Ops: ops},
+			inBody:        `{"user":{"roles":["a",{"is_admin":false,"is_admin":true}]}}`,
+			wantErrStatus: http.StatusBadRequest,
+		},
+		{
+			name:     "same keys in different objects",
+			inRW:     &RequestBodyRewrite{Ops: ops[:1]},
+			inBody:   `{"is_admin":true,"a":{"id":1},"b":[{"id":2},{"id":3}]}`,
+			wantBody: `{"a":{"id":1},"b":[{"id":2},{"id":3}]}`,
+		},
+		{
+			name:     "empty body",
+			inRW:     &RequestBodyRewrite{Ops: ops},
+			inBody:   "",
+			wantBody: "",
+		},
+		{
+			name:          "invalid json",
+			inRW:          &RequestBodyRewrite{Ops: ops},
+			inBody:        `{"is_admin":true`,
+			wantErrStatus: http.StatusBadRequest,
+		},
+		{
+			name: "invalid json value from placeholder",
+			inRW: &RequestBodyRewrite{Ops: []*RewriteOp{
+				{Op: "set_raw", Path: "tenant_id", Value: "{http.request.header.X-Tenant-Id}"},
+			}},
+			inBody:        `{}`,
+			wantErrStatus: http.StatusBadRequest,
+		},
+		{
+			name: "bad path",
+			inRW: &RequestBodyRewrite{Ops: []*RewriteOp{
+				{Op: "set", Path: "", Value: "x"},
+			}},
+			inBody:        `{}`,
+			wantErrStatus: http.StatusInternalServerError,
+		},
+		{
+			name:          "over max size",
+			inRW:          &RequestBodyRewrite{Ops: ops, MaxSize: 5},
+			inBody:        `{"is_admin":true}`,
+			wantErrStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.inRW.logger = zap.NewNop()
+			c.inRW.MaxDecodedSize = 10 << 20
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.inBody))
+			req.Header.Set("X-Tenant-Id", "t1")
+			if c.inContentType != "" {
+				req.Header.Set("Content-Type", c.inContentType)
+			}
+			if c.inEncoding != "" {
+				req.Header.Set("Content-Encoding", c.inEncoding)
+			}
+			repl := caddyhttp.NewTestReplacer(req)
+			req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+			if c.inBuffered {
+				loadBodyCache(req).buf = bytes.NewBufferString(c.inBody)
+			}
+
+			var gotBody, gotBuffered string
+			var gotLength int64
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				gotBody = string(body)
+				gotLength = r.ContentLength
+				if buf := loadBodyCache(r).buf; buf != nil {
+					gotBuffered = buf.String()
+				}
+				if r.Header.Get("Content-Encoding") != "" {
+					t.Fatalf("Content-Encoding: got (%#v), want (%#v)", r.Header.Get("Content-Encoding"), "")
+				}
+				return nil
+			})
+
+			err := c.inRW.ServeHTTP(httptest.NewRecorder(), req, next)
+			if c.wantErrStatus != 0 {
+				if handlerErr, ok := err.(caddyhttp.HandlerError); !ok || handlerErr.StatusCode != c.wantErrStatus {
+					t.Fatalf("Err: got (%#v), want status (%#v)", err, c.wantErrStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			if gotBody != c.wantBody {
+				t.Fatalf("Body: got (%#v), want (%#v)", gotBody, c.wantBody)
+			}
+			if c.wantBody != c.inBody {
+				if gotLength != int64(len(c.wantBody)) {
+					t.Fatalf("ContentLength: got (%#v), want (%#v)", gotLength, len(c.wantBody))
+				}
+				if gotBuffered != c.wantBody {
+					t.Fatalf("Buffered body: got (%#v), want (%#v)", gotBuffered, c.wantBody)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestBodyRewrite_ServeHTTP_afterRequestBodyVar(t *testing.T) {
+	rbv := RequestBodyVar{OnOversize: "empty", MaxDecodedSize: 10 << 20, logger: zap.NewNop()}
+	rw := &RequestBodyRewrite{
+		Ops:            []*RewriteOp{{Op: "set", Path: "tenant_id", Value: "t1"}},
+		MaxDecodedSize: 10 << 20,
+		logger:         zap.NewNop(),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"tenant_id":"evil"}`))
+	repl := caddyhttp.NewTestReplacer(req)
+	req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+
+	// RequestBodyVar is placed before RequestBodyRewrite, and the placeholder
+	// is resolved (thus the body is parsed) both before and after rewriting.
+	var gotValues []string
+	final := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		gotValues = append(gotValues, repl.ReplaceAll("{http.request.body.tenant_id}", ""))
+		return nil
+	})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		gotValues = append(gotValues, repl.ReplaceAll("{http.request.body.tenant_id}", ""))
+		return rw.ServeHTTP(w, r, final)
+	})
+	if err := rbv.ServeHTTP(httptest.NewRecorder(), req, next); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	want := []string{"evil", "t1"}
+	if !reflect.DeepEqual(gotValues, want) {
+		t.Fatalf("Values: got (%#v), want (%#v)", gotValues, want)
+	}
+}
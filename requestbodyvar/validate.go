@@ -0,0 +1,335 @@
+package requestbodyvar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.uber.org/zap"
+)
+
+const validationReplPrefix = "http.request.body_validation."
+
+func init() {
+	caddy.RegisterModule(RequestBodyValidate{})
+	httpcaddyfile.RegisterHandlerDirective("request_body_validate", parseValidateCaddyfile)
+}
+
+// RequestBodyValidate implements an HTTP handler that validates the request
+// body against a JSON Schema. Bodies in formats other than JSON (e.g. XML
+// and YAML) are validated after being converted into JSON, in the same way
+// as the `{http.request.body.*}` placeholders.
+//
+// The validation results are available in the following placeholders:
+//
+// - `{http.request.body_validation.valid}`: `true` or `false`.
+// - `{http.request.body_validation.errors}`: the semicolon-separated errors
+//   (sorted), each of which is in the form of `<json pointer>: <message>`.
+//
+// Note that all values converted from XML are strings.
+type RequestBodyValidate struct {
+	// The path to the JSON Schema file.
+	SchemaFile string `json:"schema_file,omitempty"`
+
+	// The maximum size (in bytes) of the request body to buffer. If the body
+	// is larger, the request will be rejected with 413 (Request Entity Too
+	// Large). Defaults to 0 (i.e. no limit).
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// The maximum size (in bytes) of the decoded request body, if the body
+	// is compressed. If the decoded body is larger, the request will be
+	// rejected with 413 (Request Entity Too Large). Defaults to 10MiB.
+	// See RequestBodyVar.MaxDecodedSize.
+	MaxDecodedSize int64 `json:"max_decoded_size,omitempty"`
+
+	// The status code of the error for invalid bodies. The error message
+	// contains the validation errors. Defaults to 400 (Bad Request).
+	StatusCode int `json:"status_code,omitempty"`
+
+	// Whether to pass invalid bodies to the next handler, instead of
+	// returning an error. Useful along with the placeholders of the
+	// validation results. Defaults to false.
+	Continue bool `json:"continue,omitempty"`
+
+	// The format of all request bodies, regardless of the `Content-Type`
+	// header. The formats of protobuf bodies are unsupported.
+	// See RequestBodyVar.Format.
+	Format string `json:"format,omitempty"`
+
+	// The extra mappings from media types to formats.
+	// See RequestBodyVar.MediaTypes.
+	MediaTypes map[string]string `json:"media_types,omitempty"`
+
+	// The format of request bodies with unsupported (or invalid) media
+	// types. Defaults to "" (i.e. such bodies are rejected with 415
+	// (Unsupported Media Type)). See RequestBodyVar.Fallback.
+	Fallback string `json:"fallback,omitempty"`
+
+	schema      *jsonschema.Schema
+	querierOpts *querierOptions
+
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (RequestBodyValidate) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.request_body_validate",
+		New: func() caddy.Module { return new(RequestBodyValidate) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (v *RequestBodyValidate) Provision(ctx caddy.Context) error {
+	v.logger = ctx.Logger(v)
+	return v.provision()
+}
+
+func (v *RequestBodyValidate) provision() (err error) {
+	if v.MaxDecodedSize == 0 {
+		v.MaxDecodedSize = 10 << 20 // At most 10MiB by default
+	}
+	if v.StatusCode == 0 {
+		v.StatusCode = http.StatusBadRequest
+	}
+	v.querierOpts = &querierOptions{
+		format:     v.Format,
+		mediaTypes: v.MediaTypes,
+		fallback:   v.Fallback,
+	}
+	if v.SchemaFile == "" {
+		return fmt.Errorf("no schema_file")
+	}
+	v.schema, err = jsonschema.Compile(v.SchemaFile)
+	return err
+}
+
+// Validate implements caddy.Validator.
+func (v *RequestBodyValidate) Validate() error {
+	if v.MaxSize < 0 {
+		return fmt.Errorf("max_size must not be negative: %d", v.MaxSize)
+	}
+	if v.MaxDecodedSize < 0 {
+		return fmt.Errorf("max_decoded_size must not be negative: %d", v.MaxDecodedSize)
+	}
+	if v.StatusCode < 400 || v.StatusCode > 599 {
+		return fmt.Errorf("status_code must be an error status: %d", v.StatusCode)
+	}
+	// There is no descriptor set for protobuf bodies.
+	if err := validateFormats(v.Format, v.MediaTypes, v.Fallback, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (v RequestBodyValidate) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	// The buffered body is shared with the other handlers (e.g.
+	// RequestBodyVar) and matchers.
+	buf, oversize, err := bufferBody(r, v.MaxSize)
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if oversize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body too large: > %d", v.MaxSize))
+	}
+
+	errs, err := v.validate(buf, r)
+	if err != nil {
+		return err
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Set(validationReplPrefix+"valid", strconv.FormatBool(len(errs) == 0))
+	repl.Set(validationReplPrefix+"errors", strings.Join(errs, "; "))
+
+	if len(errs) > 0 && !v.Continue {
+		v.logger.Debug("invalid request body", zap.Strings("errors", errs))
+		return caddyhttp.Error(v.StatusCode,
+			fmt.Errorf("invalid request body: %s", strings.Join(errs, "; ")))
+	}
+	return next.ServeHTTP(w, r)
+}
+
+// validate validates the body buffered in buf, and returns the validation
+// errors, if any. If the body can not be validated at all, the returned
+// error is a handler error with the status code of 400 (for corrupt bodies),
+// 413 (for bodies larger than MaxDecodedSize once decoded) or 415 (for
+// unsupported formats).
+func (v RequestBodyValidate) validate(buf *bytes.Buffer, r *http.Request) ([]string, error) {
+	// The querier is shared with the other handlers (e.g. RequestBodyVar)
+	// and matchers with the same options.
+	querier, err := loadBodyCache(r).querier(newQuerierKey(v.MaxSize, v.MaxDecodedSize, v.querierOpts), func() (Querier, error) {
+		body, err := decodeBody(buf, r.Header.Get("Content-Encoding"), v.MaxDecodedSize)
+		if err != nil {
+			return nil, err
+		}
+		return newQuerier(body, r.Header.Get("Content-Type"), r.URL.Path, v.querierOpts)
+	})
+	if err != nil {
+		return nil, caddyhttp.Error(bodyErrorStatus(err), err)
+	}
+	b, ok := querier.(jsonBodier)
+	if !ok {
+		return nil, caddyhttp.Error(http.StatusUnsupportedMediaType,
+			fmt.Errorf("unsupported format for validation: %T", querier))
+	}
+
+	data := b.jsonBody()
+	if data == nil {
+		return []string{"/: malformed body"}, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data.Bytes()))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return []string{"/: malformed body"}, nil
+	}
+
+	err = v.schema.Validate(doc)
+	if err == nil {
+		return nil, nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	errs := validationErrors(ve, nil)
+	sort.Strings(errs)
+	return errs, nil
+}
+
+// validationErrors appends the leaf errors of ve to errs.
+func validationErrors(ve *jsonschema.ValidationError, errs []string) []string {
+	if len(ve.Causes) == 0 {
+		loc := ve.InstanceLocation
+		if loc == "" {
+			loc = "/"
+		}
+		return append(errs, loc+": "+ve.Message)
+	}
+	for _, cause := range ve.Causes {
+		errs = validationErrors(cause, errs)
+	}
+	return errs
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//     request_body_validate <schema_file> {
+//         max_size         <size>
+//         max_decoded_size <size>
+//         status_code      <code>
+//         continue
+//
+//         format     <format>
+//         media_type <media_type> <format>
+//         fallback   <format>
+//     }
+//
+func (v *RequestBodyValidate) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		}
+		v.SchemaFile = d.Val()
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "max_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_size value %s: %v", d.Val(), err)
+				}
+				v.MaxSize = int64(size)
+
+			case "max_decoded_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("bad max_decoded_size value %s: %v", d.Val(), err)
+				}
+				v.MaxDecodedSize = int64(size)
+
+			case "status_code":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				code, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("bad status_code value %s: %v", d.Val(), err)
+				}
+				v.StatusCode = code
+
+			case "continue":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				v.Continue = true
+
+			case "format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				v.Format = d.Val()
+
+			case "media_type":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if v.MediaTypes == nil {
+					v.MediaTypes = make(map[string]string)
+				}
+				v.MediaTypes[args[0]] = args[1]
+
+			case "fallback":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				v.Fallback = d.Val()
+
+			default:
+				return d.Errf("unrecognized subdirective %s", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseValidateCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	v := new(RequestBodyValidate)
+	err := v.UnmarshalCaddyfile(h.Dispenser)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*RequestBodyValidate)(nil)
+	_ caddy.Validator             = (*RequestBodyValidate)(nil)
+	_ caddyhttp.MiddlewareHandler = (*RequestBodyValidate)(nil)
+	_ caddyfile.Unmarshaler       = (*RequestBodyValidate)(nil)
+)
@@ -0,0 +1,214 @@
+package requestbodyvar
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func TestRequestBodyValidate_ServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "requestbodyvar")
+	if err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	schemaFile := filepath.Join(dir, "schema.json")
+	schema := `{
+  "type": "object",
+  "required": ["name"],
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "age": {"type": "integer", "minimum": 0}
+  }
+}`
+	if err := ioutil.WriteFile(schemaFile, []byte(schema), 0644); err != nil {
+		t.Fatalf("Err: %v", err)
+	}
+
+	cases := []struct {
+		name          string
+		inValidate    *RequestBodyValidate
+		inBody        string
+		inContentType string
+		inEncoding    string
+		wantErrStatus int
+		wantValid     string
+		wantErrors    string
+	}{
+		{
+			name:       "valid",
+			inValidate: &RequestBodyValidate{},
+			inBody:     `{"name":"caddy","age":5}`,
+			wantValid:  "true",
+		},
+		{
+			name:          "invalid",
+			inValidate:    &RequestBodyValidate{},
+			inBody:        `{"age":-1}`,
+			wantErrStatus: http.StatusBadRequest,
+		},
+		{
+			name:          "invalid with status code",
+			inValidate:    &RequestBodyValidate{StatusCode: http.StatusUnprocessableEntity},
+			inBody:        `{"age":-1}`,
+			wantErrStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "invalid with continue",
+			inValidate: &RequestBodyValidate{Continue: true},
+			inBody:     `{"name":"","age":1.5}`,
+			wantValid:  "false",
+			wantErrors: "/age: expected integer, but got number; /name: length must be >= 1, but got 0",
+		},
+		{
+			name:       "malformed with continue",
+			inValidate: &RequestBodyValidate{Continue: true},
+			inBody:     `{"name":`,
+			wantValid:  "false",
+			wantErrors: "/: malformed body",
+		},
+		{
+			name:          "yaml",
+			inValidate:    &RequestBodyValidate{Continue: true},
+			inBody:        "name: caddy\nage: 5\n",
+			inContentType: "application/yaml",
+			wantValid:     "true",
+		},
+		{
+			name:          "xml",
+			inValidate:    &RequestBodyValidate{Continue: true},
+			inBody:        `<age>5</age>`,
+			inContentType: "application/xml",
+			wantValid:     "false",
+			// All values converted from XML are strings.
+			wantErrors: "/: missing properties: 'name'; /age: expected integer, but got string",
+		},
+		{
+			name:          "unsupported format",
+			inValidate:    &RequestBodyValidate{},
+			inBody:        "name=caddy",
+			inContentType: "application/x-www-form-urlencoded",
+			wantErrStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:          "unsupported media type",
+			inValidate:    &RequestBodyValidate{},
+			inBody:        `{"name":"caddy"}`,
+			inContentType: "text/plain",
+			wantErrStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:          "fallback",
+			inValidate:    &RequestBodyValidate{Fallback: formatJSON},
+			inBody:        `{"name":"caddy"}`,
+			inContentType: "text/plain",
+			wantValid:     "true",
+		},
+		{
+			name:          "media type",
+			inValidate:    &RequestBodyValidate{MediaTypes: map[string]string{"application/vnd.api+json": formatJSON}},
+			inBody:        `{"name":"caddy"}`,
+			inContentType: "application/vnd.api+json",
+			wantValid:     "true",
+		},
+		{
+			name:          "format",
+			inValidate:    &RequestBodyValidate{Format: formatYAML, Continue: true},
+			inBody:        "name: caddy\n",
+			inContentType: "application/json",
+			wantValid:     "true",
+		},
+		{
+			name:          "corrupt gzip",
+			inValidate:    &RequestBodyValidate{},
+			inBody:        `{"name":"caddy"}`,
+			inEncoding:    "gzip",
+			wantErrStatus: http.StatusBadRequest,
+		},
+		{
+			name:          "over max decoded size",
+			inValidate:    &RequestBodyValidate{MaxDecodedSize: 5},
+			inBody:        encode(t, `{"name":"caddy"}`, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }),
+			inEncoding:    "gzip",
+			wantErrStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "unsupported encoding",
+			inValidate:    &RequestBodyValidate{},
+			inBody:        `{"name":"caddy"}`,
+			inEncoding:    "compress",
+			wantErrStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:          "over max size",
+			inValidate:    &RequestBodyValidate{MaxSize: 5},
+			inBody:        `{"name":"caddy"}`,
+			wantErrStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v := c.inValidate
+			v.SchemaFile = schemaFile
+			v.logger = zap.NewNop()
+			if err := v.provision(); err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.inBody))
+			if c.inContentType != "" {
+				req.Header.Set("Content-Type", c.inContentType)
+			}
+			if c.inEncoding != "" {
+				req.Header.Set("Content-Encoding", c.inEncoding)
+			}
+			repl := caddyhttp.NewTestReplacer(req)
+			req = withVars(req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, repl)))
+
+			var gotBody string
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				body, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				gotBody = string(body)
+				return nil
+			})
+
+			err := v.ServeHTTP(httptest.NewRecorder(), req, next)
+			if c.wantErrStatus != 0 {
+				if handlerErr, ok := err.(caddyhttp.HandlerError); !ok || handlerErr.StatusCode != c.wantErrStatus {
+					t.Fatalf("Err: got (%#v), want status (%#v)", err, c.wantErrStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Err: %v", err)
+			}
+
+			if valid := repl.ReplaceAll("{http.request.body_validation.valid}", ""); valid != c.wantValid {
+				t.Fatalf("Valid: got (%#v), want (%#v)", valid, c.wantValid)
+			}
+			if errs := repl.ReplaceAll("{http.request.body_validation.errors}", ""); errs != c.wantErrors {
+				t.Fatalf("Errors: got (%#v), want (%#v)", errs, c.wantErrors)
+			}
+			// The body must be left intact.
+			if gotBody != c.inBody {
+				t.Fatalf("Body: got (%#v), want (%#v)", gotBody, c.inBody)
+			}
+		})
+	}
+}